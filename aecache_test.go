@@ -0,0 +1,74 @@
+package aecache_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StalkR/aecache"
+	"github.com/StalkR/aecache/aecachetest"
+)
+
+// The RequestCache is left out: the suite uses contexts without a map of
+// items, so it would drop every write. The datastore and memcache layers
+// need a server.
+
+func TestMemoryCacheConformance(t *testing.T) {
+	aecachetest.CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		return aecache.NewMemoryCache(aecache.WithClock(clock))
+	})
+}
+
+func TestShardedMemoryCacheConformance(t *testing.T) {
+	aecachetest.CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		return aecache.NewShardedMemoryCache(4, aecache.WithClock(clock))
+	})
+}
+
+func TestSyncMapCacheConformance(t *testing.T) {
+	aecachetest.CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		return aecache.NewSyncMapCache(aecache.WithClock(clock))
+	})
+}
+
+func TestBoltCacheConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var caches []*aecache.BoltCache
+	defer func() {
+		for _, c := range caches {
+			c.Close()
+		}
+	}()
+	aecachetest.CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		c, err := aecache.NewBoltCache(filepath.Join(dir, fmt.Sprintf("%d.db", len(caches))), aecache.WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		caches = append(caches, c)
+		return c
+	})
+}
+
+func TestCombinedCacheConformance(t *testing.T) {
+	aecachetest.CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		return aecache.NewCombinedCache([]aecache.Cache{
+			aecache.NewMemoryCache(aecache.WithClock(clock)),
+			aecache.NewSyncMapCache(aecache.WithClock(clock)),
+			aecache.NewShardedMemoryCache(4, aecache.WithClock(clock)),
+		}, aecache.WithClock(clock))
+	})
+}
+
+// TestMemoryCacheConformanceRealClock runs the suite with the real clock, as
+// third-party layers without a Clock do.
+func TestMemoryCacheConformanceRealClock(t *testing.T) {
+	aecachetest.CacheConformance(t, func() aecache.Cache {
+		return aecache.NewMemoryCache()
+	})
+}
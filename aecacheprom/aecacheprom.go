@@ -0,0 +1,102 @@
+// Package aecacheprom exports the stats of aecache layers as Prometheus
+// metrics. It is a separate package so that aecache does not depend on
+// Prometheus.
+package aecacheprom
+
+import (
+	"github.com/StalkR/aecache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Collector represents a prometheus.Collector of the stats of named cache
+// layers. Metrics are read from the layers when scraped, so there is no
+// overhead per request. Layers export the metrics they support: counters
+// for a Statser, number of items and bytes for layers with Len and Bytes,
+// like MemoryCache, and refills for a CombinedCache.
+type Collector struct {
+	caches     map[string]aecache.Cache
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	evictions  *prometheus.Desc
+	items      *prometheus.Desc
+	bytes      *prometheus.Desc
+	pending    *prometheus.Desc
+	enqueued   *prometheus.Desc
+	executed   *prometheus.Desc
+	background *prometheus.Desc
+	dropped    *prometheus.Desc
+}
+
+// Check at compile time that Collector implements prometheus.Collector.
+var _ prometheus.Collector = (*Collector)(nil)
+
+// A sizer represents a cache layer which knows its size.
+type sizer interface {
+	Len() int
+	Bytes() int
+}
+
+// A combinedStatser represents a cache which counts its refills, like
+// CombinedCache.
+type combinedStatser interface {
+	Stats() aecache.CombinedStats
+}
+
+// NewCollector creates a new Collector for cache layers by name, the name
+// being the "layer" label of the metrics. The hit ratio of a layer can be
+// graphed as rate(aecache_hits_total) / (rate(aecache_hits_total) +
+// rate(aecache_misses_total)).
+func NewCollector(caches map[string]aecache.Cache) *Collector {
+	labels := []string{"layer"}
+	return &Collector{
+		caches:     caches,
+		hits:       prometheus.NewDesc("aecache_hits_total", "Gets which found an item.", labels, nil),
+		misses:     prometheus.NewDesc("aecache_misses_total", "Gets which did not find an item.", labels, nil),
+		evictions:  prometheus.NewDesc("aecache_evictions_total", "Items removed as expired or for capacity.", labels, nil),
+		items:      prometheus.NewDesc("aecache_items", "Number of items, expired included until removed.", labels, nil),
+		bytes:      prometheus.NewDesc("aecache_bytes", "Summed length of the values.", labels, nil),
+		pending:    prometheus.NewDesc("aecache_refills_pending", "Refills batched, not yet written.", labels, nil),
+		enqueued:   prometheus.NewDesc("aecache_refills_enqueued_total", "Refills of a faster layer.", labels, nil),
+		executed:   prometheus.NewDesc("aecache_refills_executed_total", "Refills written, successfully or not.", labels, nil),
+		background: prometheus.NewDesc("aecache_refreshes_background", "Background refreshes in flight.", labels, nil),
+		dropped:    prometheus.NewDesc("aecache_refreshes_dropped_total", "Background refreshes skipped as saturated.", labels, nil),
+	}
+}
+
+// Describe sends the descriptors of the metrics.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.items
+	ch <- c.bytes
+	ch <- c.pending
+	ch <- c.enqueued
+	ch <- c.executed
+	ch <- c.background
+	ch <- c.dropped
+}
+
+// Collect sends the metrics of the cache layers.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for name, cache := range c.caches {
+		if s, ok := cache.(aecache.Statser); ok {
+			stats := s.Stats()
+			ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits), name)
+			ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses), name)
+			ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.Evictions), name)
+		}
+		if s, ok := cache.(sizer); ok {
+			ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(s.Len()), name)
+			ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(s.Bytes()), name)
+		}
+		if s, ok := cache.(combinedStatser); ok {
+			stats := s.Stats().Refills
+			ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(stats.Pending), name)
+			ch <- prometheus.MustNewConstMetric(c.enqueued, prometheus.CounterValue, float64(stats.Enqueued), name)
+			ch <- prometheus.MustNewConstMetric(c.executed, prometheus.CounterValue, float64(stats.Executed), name)
+			ch <- prometheus.MustNewConstMetric(c.background, prometheus.GaugeValue, float64(stats.Background), name)
+			ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped), name)
+		}
+	}
+}
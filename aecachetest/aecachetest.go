@@ -0,0 +1,487 @@
+// Package aecachetest provides a conformance suite for aecache.Cache
+// implementations, so that third-party layers can check they behave as
+// CombinedCache expects.
+package aecachetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/StalkR/aecache"
+)
+
+// CacheConformance runs the conformance suite against caches created by
+// newCache, one per subtest: set/get, items with metadata, add, deletes,
+// deletes by tag, flush, expiry, misses, a random sequence of operations
+// checked against a model, and concurrent use. The cache must use the real
+// clock and have no capacity limit. The expiry subtests sleep for a fraction
+// of a second, and are skipped with -short; see CacheConformanceWithClock to
+// run them without sleeping.
+func CacheConformance(t *testing.T, newCache func() aecache.Cache) {
+	run(t, sleepClock{}, func(aecache.Clock) aecache.Cache {
+		return newCache()
+	})
+}
+
+// CacheConformanceWithClock runs the conformance suite as CacheConformance,
+// against caches created by newCache with a FakeClock they must use for
+// expirations, so the expiry subtests advance it instead of sleeping.
+func CacheConformanceWithClock(t *testing.T, newCache func(clock aecache.Clock) aecache.Cache) {
+	run(t, nil, newCache)
+}
+
+// run runs the conformance suite with clk, or a new FakeClock per subtest
+// if nil.
+func run(t *testing.T, clk clock, newCache func(clock aecache.Clock) aecache.Cache) {
+	tests := []struct {
+		name   string
+		f      func(t *testing.T, c aecache.Cache, clk clock)
+		sleeps bool // advances the clock
+	}{
+		{"Miss", testMiss, false},
+		{"SetGet", testSetGet, false},
+		{"SetItemGetItem", testSetItemGetItem, false},
+		{"Overwrite", testOverwrite, false},
+		{"NoExpiration", testNoExpiration, false},
+		{"Expiry", testExpiry, true},
+		{"Clean", testClean, true},
+		{"Add", testAdd, false},
+		{"Delete", testDelete, false},
+		{"DeleteMulti", testDeleteMulti, false},
+		{"DeletePrefix", testDeletePrefix, false},
+		{"DeleteByTag", testDeleteByTag, false},
+		{"Flush", testFlush, false},
+		{"Random", testRandom, false},
+		{"Concurrent", testConcurrent, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clk
+			if clk == nil {
+				clk = NewFakeClock()
+			} else if tt.sleeps && testing.Short() {
+				t.Skip("sleeps with the real clock")
+			}
+			tt.f(t, newCache(clk), clk)
+		})
+	}
+}
+
+// expectMiss fails if a key is not a miss, for both Get and GetItem.
+func expectMiss(t *testing.T, c aecache.Cache, key string) {
+	t.Helper()
+	ctx := context.Background()
+	if _, _, err := c.Get(ctx, key); err != aecache.ErrCacheMiss {
+		t.Errorf("Get(%q): got err %v; want ErrCacheMiss", key, err)
+	}
+	if _, err := c.GetItem(ctx, key); err != aecache.ErrCacheMiss {
+		t.Errorf("GetItem(%q): got err %v; want ErrCacheMiss", key, err)
+	}
+}
+
+// expectValue fails if a key is not set to value.
+func expectValue(t *testing.T, c aecache.Cache, key string, value []byte) {
+	t.Helper()
+	got, _, err := c.Get(context.Background(), key)
+	if err != nil {
+		t.Errorf("Get(%q): %v", key, err)
+		return
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Get(%q): got %q; want %q", key, got, value)
+	}
+}
+
+func testMiss(t *testing.T, c aecache.Cache, clk clock) {
+	expectMiss(t, c, "missing")
+}
+
+func testSetGet(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	before := clk.Now()
+	if err := c.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	after := clk.Now()
+	value, expires, err := c.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(value) != "value" {
+		t.Errorf("Get: got value %q; want %q", value, "value")
+	}
+	// Layers may store expirations with a coarser precision.
+	if expires.Before(before.Add(time.Minute-time.Second)) || expires.After(after.Add(time.Minute+time.Second)) {
+		t.Errorf("Get: got expiration %v; want about %v", expires, before.Add(time.Minute))
+	}
+}
+
+func testSetItemGetItem(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	item := aecache.Item{
+		Value:   []byte("value"),
+		Expires: clk.Now().Add(time.Minute),
+		Meta:    map[string]string{"Content-Type": "text/plain"},
+	}
+	if err := c.SetItem(ctx, "key", item); err != nil {
+		t.Fatalf("SetItem: %v", err)
+	}
+	got, err := c.GetItem(ctx, "key")
+	if err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+	if !bytes.Equal(got.Value, item.Value) {
+		t.Errorf("GetItem: got value %q; want %q", got.Value, item.Value)
+	}
+	if d := got.Expires.Sub(item.Expires); d < -time.Second || d > time.Second {
+		t.Errorf("GetItem: got expiration %v; want %v", got.Expires, item.Expires)
+	}
+	if got.Meta["Content-Type"] != "text/plain" {
+		t.Errorf("GetItem: got meta %v; want %v", got.Meta, item.Meta)
+	}
+	expectValue(t, c, "key", item.Value)
+}
+
+func testOverwrite(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", []byte("old"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Set(ctx, "key", []byte("new"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	expectValue(t, c, "key", []byte("new"))
+}
+
+func testNoExpiration(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	if err := c.Set(ctx, "zero", []byte("value"), 0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	expectMiss(t, c, "zero")
+	past := aecache.Item{Value: []byte("value"), Expires: clk.Now().Add(-time.Minute)}
+	if err := c.SetItem(ctx, "past", past); err != nil {
+		t.Fatalf("SetItem: %v", err)
+	}
+	expectMiss(t, c, "past")
+}
+
+func testExpiry(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", []byte("value"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clk.Advance(100 * time.Millisecond)
+	expectMiss(t, c, "key")
+}
+
+func testClean(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	if err := c.Set(ctx, "short", []byte("value"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Set(ctx, "long", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	clk.Advance(100 * time.Millisecond)
+	if err := c.Clean(ctx); err != nil {
+		t.Fatalf("Clean: %v", err)
+	}
+	expectMiss(t, c, "short")
+	expectValue(t, c, "long", []byte("value"))
+}
+
+func testAdd(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	added, err := c.Add(ctx, "key", []byte("first"), time.Minute)
+	if err != nil || !added {
+		t.Fatalf("Add: got %v, %v; want true, nil", added, err)
+	}
+	added, err = c.Add(ctx, "key", []byte("second"), time.Minute)
+	if err != nil || added {
+		t.Fatalf("Add: got %v, %v; want false, nil", added, err)
+	}
+	expectValue(t, c, "key", []byte("first"))
+}
+
+func testDelete(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectMiss(t, c, "key")
+	if err := c.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func testDeleteMulti(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := c.DeleteMulti(ctx, []string{"a", "b", "missing"}); err != nil {
+		t.Fatalf("DeleteMulti: %v", err)
+	}
+	expectMiss(t, c, "a")
+	expectMiss(t, c, "b")
+	expectValue(t, c, "c", []byte("c"))
+}
+
+func testDeletePrefix(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	for _, key := range []string{"user:1", "user:2", "page:1"} {
+		if err := c.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := c.DeletePrefix(ctx, "user:"); err != nil {
+		t.Fatalf("DeletePrefix: %v", err)
+	}
+	expectMiss(t, c, "user:1")
+	expectMiss(t, c, "user:2")
+	expectValue(t, c, "page:1", []byte("page:1"))
+}
+
+func testDeleteByTag(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	tags := map[string]string{"a1": "a", "a2": "a", "b1": "b", "none": ""}
+	for key, tag := range tags {
+		item := aecache.Item{Value: []byte(key), Expires: clk.Now().Add(time.Minute)}
+		if tag != "" {
+			item.Meta = map[string]string{aecache.TagMeta: tag}
+		}
+		if err := c.SetItem(ctx, key, item); err != nil {
+			t.Fatalf("SetItem: %v", err)
+		}
+	}
+	// Overwriting without the tag untags the key.
+	if err := c.Set(ctx, "a2", []byte("a2"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.DeleteByTag(ctx, "a"); err != nil {
+		t.Fatalf("DeleteByTag: %v", err)
+	}
+	expectMiss(t, c, "a1")
+	expectValue(t, c, "a2", []byte("a2"))
+	expectValue(t, c, "b1", []byte("b1"))
+	expectValue(t, c, "none", []byte("none"))
+}
+
+// A flusher represents a cache which can delete all items but some.
+type flusher interface {
+	FlushExcept(ctx context.Context, keep ...string) error
+}
+
+// testFlush deletes all items with DeletePrefix of the empty prefix, and
+// with FlushExcept if the cache has it.
+func testFlush(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	keys := []string{"a", "b", "c"}
+	set := func() {
+		for _, key := range keys {
+			if err := c.Set(ctx, key, []byte(key), time.Minute); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+	set()
+	if err := c.DeletePrefix(ctx, ""); err != nil {
+		t.Fatalf("DeletePrefix(\"\"): %v", err)
+	}
+	for _, key := range keys {
+		expectMiss(t, c, key)
+	}
+	f, ok := c.(flusher)
+	if !ok {
+		return
+	}
+	set()
+	if err := f.FlushExcept(ctx, "b"); err != nil {
+		t.Fatalf("FlushExcept: %v", err)
+	}
+	expectMiss(t, c, "a")
+	expectValue(t, c, "b", []byte("b"))
+	expectMiss(t, c, "c")
+}
+
+// A modelItem is the item a key is expected to hold in testRandom.
+type modelItem struct {
+	value   string
+	expires time.Time
+	tag     string
+}
+
+// randomSeed seeds testRandom, fixed so failures reproduce.
+const randomSeed = 1
+
+// testRandom runs a seeded random sequence of operations on a few keys and
+// checks every read against a model map. With a FakeClock, it also advances
+// time so items expire; with the real clock, items outlive the test.
+func testRandom(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(randomSeed))
+	_, fake := clk.(*FakeClock)
+	model := make(map[string]modelItem)
+	keys := []string{"a:0", "a:1", "a:2", "b:0", "b:1", "b:2"}
+	tags := []string{"", "x", "y"}
+	randomKey := func() string { return keys[rnd.Intn(len(keys))] }
+	randomExpiration := func() time.Duration {
+		if fake {
+			return time.Duration(1+rnd.Intn(10)) * time.Second
+		}
+		return time.Duration(1+rnd.Intn(10)) * time.Hour
+	}
+	live := func(key string) (modelItem, bool) {
+		e, ok := model[key]
+		if !ok || e.expires.Before(clk.Now()) {
+			return modelItem{}, false
+		}
+		return e, true
+	}
+	for i := 0; i < 2000; i++ {
+		key := randomKey()
+		value := fmt.Sprintf("%s-%d", key, i)
+		switch op := rnd.Intn(10); op {
+		case 0:
+			expiration := randomExpiration()
+			if err := c.Set(ctx, key, []byte(value), expiration); err != nil {
+				t.Fatalf("op %d: Set(%q): %v", i, key, err)
+			}
+			model[key] = modelItem{value: value, expires: clk.Now().Add(expiration)}
+		case 1:
+			tag := tags[rnd.Intn(len(tags))]
+			item := aecache.Item{Value: []byte(value), Expires: clk.Now().Add(randomExpiration())}
+			if tag != "" {
+				item.Meta = map[string]string{aecache.TagMeta: tag}
+			}
+			if err := c.SetItem(ctx, key, item); err != nil {
+				t.Fatalf("op %d: SetItem(%q): %v", i, key, err)
+			}
+			model[key] = modelItem{value: value, expires: item.Expires, tag: tag}
+		case 2:
+			expiration := randomExpiration()
+			added, err := c.Add(ctx, key, []byte(value), expiration)
+			if err != nil {
+				t.Fatalf("op %d: Add(%q): %v", i, key, err)
+			}
+			_, exists := live(key)
+			if added == exists {
+				t.Fatalf("op %d: Add(%q): got %v; want %v", i, key, added, !exists)
+			}
+			if added {
+				model[key] = modelItem{value: value, expires: clk.Now().Add(expiration)}
+			}
+		case 3:
+			if err := c.Delete(ctx, key); err != nil {
+				t.Fatalf("op %d: Delete(%q): %v", i, key, err)
+			}
+			delete(model, key)
+		case 4:
+			other := randomKey()
+			if err := c.DeleteMulti(ctx, []string{key, other}); err != nil {
+				t.Fatalf("op %d: DeleteMulti(%q, %q): %v", i, key, other, err)
+			}
+			delete(model, key)
+			delete(model, other)
+		case 5:
+			prefix := key[:2]
+			if err := c.DeletePrefix(ctx, prefix); err != nil {
+				t.Fatalf("op %d: DeletePrefix(%q): %v", i, prefix, err)
+			}
+			for k := range model {
+				if strings.HasPrefix(k, prefix) {
+					delete(model, k)
+				}
+			}
+		case 6:
+			tag := tags[1+rnd.Intn(len(tags)-1)]
+			if err := c.DeleteByTag(ctx, tag); err != nil {
+				t.Fatalf("op %d: DeleteByTag(%q): %v", i, tag, err)
+			}
+			for k, e := range model {
+				if e.tag == tag {
+					delete(model, k)
+				}
+			}
+		case 7:
+			if fake {
+				clk.Advance(time.Duration(rnd.Intn(3000)) * time.Millisecond)
+			}
+			if err := c.Clean(ctx); err != nil {
+				t.Fatalf("op %d: Clean: %v", i, err)
+			}
+		default:
+			got, err := c.GetItem(ctx, key)
+			e, ok := live(key)
+			switch {
+			case !ok && err != aecache.ErrCacheMiss:
+				t.Fatalf("op %d: GetItem(%q): got %q, %v; want ErrCacheMiss", i, key, got.Value, err)
+			case ok && err != nil:
+				t.Fatalf("op %d: GetItem(%q): %v; want %q", i, key, err, e.value)
+			case ok && string(got.Value) != e.value:
+				t.Fatalf("op %d: GetItem(%q): got %q; want %q", i, key, got.Value, e.value)
+			}
+		}
+	}
+}
+
+// testConcurrent runs writers and readers on shared keys: a read must either
+// miss or get one of the values written, never a mix. Run with -race.
+func testConcurrent(t *testing.T, c aecache.Cache, clk clock) {
+	ctx := context.Background()
+	const (
+		goroutines = 8
+		iterations = 100
+		keys       = 4
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*iterations)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				key := fmt.Sprintf("key%d", i%keys)
+				want := []byte(fmt.Sprintf("%s-%d", key, g))
+				if err := c.Set(ctx, key, want, time.Minute); err != nil {
+					errs <- fmt.Errorf("Set(%q): %v", key, err)
+					continue
+				}
+				value, _, err := c.Get(ctx, key)
+				if err == aecache.ErrCacheMiss {
+					continue
+				}
+				if err != nil {
+					errs <- fmt.Errorf("Get(%q): %v", key, err)
+					continue
+				}
+				if !bytes.HasPrefix(value, []byte(key+"-")) {
+					errs <- fmt.Errorf("Get(%q): got %q, not written to this key", key, value)
+				}
+				if i%10 == 0 {
+					if err := c.Delete(ctx, key); err != nil {
+						errs <- fmt.Errorf("Delete(%q): %v", key, err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package aecachetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/StalkR/aecache"
+)
+
+// Check at compile time that FakeClock implements aecache.Clock.
+var _ aecache.Clock = (*FakeClock)(nil)
+
+// A FakeClock represents a clock whose time only moves with Advance, so
+// tests of expirations are deterministic and do not sleep. It is safe for
+// concurrent use.
+type FakeClock struct {
+	m   sync.Mutex // protects below
+	now time.Time
+}
+
+// NewFakeClock creates a new FakeClock set to the current time, so items it
+// expires are also valid for backends expiring them on their own clock,
+// like memcached.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Now()}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// A clock is the time of a conformance run: a FakeClock, or the real time
+// advanced by sleeping.
+type clock interface {
+	aecache.Clock
+	Advance(d time.Duration)
+}
+
+// sleepClock is a clock using the real time, advanced by sleeping.
+type sleepClock struct{}
+
+// Now returns the current system time.
+func (sleepClock) Now() time.Time {
+	return time.Now()
+}
+
+// Advance sleeps for d.
+func (sleepClock) Advance(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,197 @@
+package aecachetest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StalkR/aecache"
+)
+
+// Check at compile time that FakeCache implements aecache.Cache.
+var _ aecache.Cache = (*FakeCache)(nil)
+
+// A Call represents a call to a FakeCache.
+type Call struct {
+	// Op is the operation, as recorded by aecache.Timed: set, setitem, add,
+	// get, getitem, clean, delete, deleteif, deletemulti, deleteprefix,
+	// deletebytag.
+	Op string
+	// Key is the key, the prefix or the tag of the operation, the keys joined
+	// by commas for deletemulti, or empty for clean.
+	Key string
+}
+
+// A FakeCache represents a cache with programmable behavior for tests of
+// code using a Cache: it can miss keys, fail calls and add latency, and
+// records its calls. Otherwise it behaves as an aecache.MemoryCache.
+type FakeCache struct {
+	cache   aecache.Cache
+	m       sync.Mutex // protects below
+	miss    func(key string) bool
+	errs    map[int]error // by call number, from 1
+	latency time.Duration
+	calls   []Call
+}
+
+// NewFakeCache creates a new FakeCache, empty and behaving normally.
+// It supports the options of aecache.NewMemoryCache, e.g. aecache.WithClock
+// to expire items on a FakeClock.
+func NewFakeCache(opts ...aecache.Option) *FakeCache {
+	return &FakeCache{
+		cache: aecache.NewMemoryCache(opts...),
+		errs:  make(map[int]error),
+	}
+}
+
+// MissKeys makes gets of keys matching f miss, whether set or not.
+// A nil f stops forcing misses.
+func (f *FakeCache) MissKeys(match func(key string) bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.miss = match
+}
+
+// FailCall makes the nth call, counting from 1 since creation, return err
+// instead of doing anything.
+func (f *FakeCache) FailCall(n int, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.errs[n] = err
+}
+
+// SetLatency makes calls wait for d before doing anything, or until their
+// context is done, in which case they return its error.
+func (f *FakeCache) SetLatency(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.latency = d
+}
+
+// Calls returns the calls made so far, in order.
+func (f *FakeCache) Calls() []Call {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// call records a call then applies latency and injected errors.
+func (f *FakeCache) call(ctx context.Context, op, key string) error {
+	f.m.Lock()
+	f.calls = append(f.calls, Call{Op: op, Key: key})
+	err := f.errs[len(f.calls)]
+	latency := f.latency
+	f.m.Unlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// missed tells whether gets of a key are forced to miss.
+func (f *FakeCache) missed(key string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.miss != nil && f.miss(key)
+}
+
+// Set sets a key to a value with an expiration.
+func (f *FakeCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if err := f.call(ctx, "set", key); err != nil {
+		return err
+	}
+	return f.cache.Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (f *FakeCache) SetItem(ctx context.Context, key string, item aecache.Item) error {
+	if err := f.call(ctx, "setitem", key); err != nil {
+		return err
+	}
+	return f.cache.SetItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (f *FakeCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if err := f.call(ctx, "add", key); err != nil {
+		return false, err
+	}
+	return f.cache.Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (f *FakeCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	if err := f.call(ctx, "get", key); err != nil {
+		return nil, time.Time{}, err
+	}
+	if f.missed(key) {
+		return nil, time.Time{}, aecache.ErrCacheMiss
+	}
+	return f.cache.Get(ctx, key)
+}
+
+// GetItem gets the item for a key.
+func (f *FakeCache) GetItem(ctx context.Context, key string) (aecache.Item, error) {
+	if err := f.call(ctx, "getitem", key); err != nil {
+		return aecache.Item{}, err
+	}
+	if f.missed(key) {
+		return aecache.Item{}, aecache.ErrCacheMiss
+	}
+	return f.cache.GetItem(ctx, key)
+}
+
+// Clean deletes expired items.
+func (f *FakeCache) Clean(ctx context.Context) error {
+	if err := f.call(ctx, "clean", ""); err != nil {
+		return err
+	}
+	return f.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (f *FakeCache) Delete(ctx context.Context, key string) error {
+	if err := f.call(ctx, "delete", key); err != nil {
+		return err
+	}
+	return f.cache.Delete(ctx, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (f *FakeCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	if err := f.call(ctx, "deleteif", key); err != nil {
+		return false, err
+	}
+	return f.cache.(aecache.ConditionalDeleter).DeleteIf(ctx, key, expected)
+}
+
+// DeleteMulti deletes keys.
+func (f *FakeCache) DeleteMulti(ctx context.Context, keys []string) error {
+	if err := f.call(ctx, "deletemulti", strings.Join(keys, ",")); err != nil {
+		return err
+	}
+	return f.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (f *FakeCache) DeletePrefix(ctx context.Context, prefix string) error {
+	if err := f.call(ctx, "deleteprefix", prefix); err != nil {
+		return err
+	}
+	return f.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func (f *FakeCache) DeleteByTag(ctx context.Context, tag string) error {
+	if err := f.call(ctx, "deletebytag", tag); err != nil {
+		return err
+	}
+	return f.cache.DeleteByTag(ctx, tag)
+}
@@ -0,0 +1,95 @@
+package aecachetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/StalkR/aecache"
+)
+
+func TestFakeCacheConformance(t *testing.T) {
+	CacheConformanceWithClock(t, func(clock aecache.Clock) aecache.Cache {
+		return NewFakeCache(aecache.WithClock(clock))
+	})
+}
+
+func TestFakeCacheMissKeys(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeCache()
+	f.Set(ctx, "a", []byte("a"), time.Hour)
+	f.Set(ctx, "b", []byte("b"), time.Hour)
+	f.MissKeys(func(key string) bool { return key == "a" })
+	if _, err := f.GetItem(ctx, "a"); err != aecache.ErrCacheMiss {
+		t.Errorf("GetItem(a) = %v; want ErrCacheMiss", err)
+	}
+	if _, err := f.GetItem(ctx, "b"); err != nil {
+		t.Errorf("GetItem(b) = %v; want hit", err)
+	}
+	f.MissKeys(nil)
+	if _, err := f.GetItem(ctx, "a"); err != nil {
+		t.Errorf("GetItem(a) after MissKeys(nil) = %v; want hit", err)
+	}
+}
+
+func TestFakeCacheFailCall(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeCache()
+	fail := errors.New("injected")
+	f.FailCall(2, fail)
+	if err := f.Set(ctx, "a", []byte("a"), time.Hour); err != nil {
+		t.Errorf("call 1: Set = %v; want nil", err)
+	}
+	if err := f.Set(ctx, "b", []byte("b"), time.Hour); err != fail {
+		t.Errorf("call 2: Set = %v; want injected error", err)
+	}
+	if _, err := f.GetItem(ctx, "b"); err != aecache.ErrCacheMiss {
+		t.Errorf("call 3: GetItem(b) = %v; want ErrCacheMiss as its Set failed", err)
+	}
+}
+
+func TestFakeCacheLatency(t *testing.T) {
+	f := NewFakeCache()
+	f.SetLatency(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.Set(ctx, "a", []byte("a"), time.Hour); err != context.Canceled {
+		t.Errorf("Set with canceled context = %v; want context.Canceled", err)
+	}
+}
+
+func TestFakeCacheCalls(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock()
+	f := NewFakeCache(aecache.WithClock(clock))
+	f.Set(ctx, "a", []byte("a"), time.Minute)
+	f.Get(ctx, "a")
+	f.DeleteMulti(ctx, []string{"a", "b"})
+	f.Clean(ctx)
+	want := []Call{
+		{"set", "a"},
+		{"get", "a"},
+		{"deletemulti", "a,b"},
+		{"clean", ""},
+	}
+	if got := f.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %v; want %v", got, want)
+	}
+}
+
+func TestFakeCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock()
+	f := NewFakeCache(aecache.WithClock(clock))
+	f.Set(ctx, "a", []byte("a"), time.Minute)
+	clock.Advance(time.Minute - time.Second)
+	if _, err := f.GetItem(ctx, "a"); err != nil {
+		t.Errorf("GetItem before expiry = %v; want hit", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := f.GetItem(ctx, "a"); err != aecache.ErrCacheMiss {
+		t.Errorf("GetItem after expiry = %v; want ErrCacheMiss", err)
+	}
+}
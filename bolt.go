@@ -0,0 +1,289 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket where BoltCache stores items.
+var boltBucket = []byte("CacheItem")
+
+// A BoltCache represents a cache persisted in an embedded bbolt database,
+// for single-instance deployments without a cloud dependency.
+// Items are stored encoded with EncodeItem.
+type BoltCache struct {
+	clock Clock
+	db    *bolt.DB
+}
+
+// NewBoltCache opens or creates a bbolt database at path as a cache.
+// It supports the WithClock option. It must be closed with Close.
+func NewBoltCache(path string, opts ...Option) (*BoltCache, error) {
+	o := newOptions(opts...)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltCache{clock: o.clock, db: db}, nil
+}
+
+// Close flushes and releases the database file.
+func (a *BoltCache) Close() error {
+	return a.db.Close()
+}
+
+// Ping checks the cache is healthy, which it always is.
+func (a *BoltCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Name returns the name of the layer.
+func (a *BoltCache) Name() string {
+	return "bolt"
+}
+
+// Set sets a key to a value with an expiration.
+func (a *BoltCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *BoltCache) SetItem(ctx context.Context, key string, item Item) error {
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	b, err := EncodeItem(stamp(ctx, item, a.clock.Now()))
+	if err != nil {
+		return err
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), b)
+	})
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *BoltCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		return false, nil
+	}
+	var added bool
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		now := a.clock.Now()
+		if v := bucket.Get([]byte(key)); v != nil {
+			item, err := DecodeItem(v)
+			if err != nil {
+				return err
+			}
+			if !item.Expires.Before(now) {
+				return nil
+			}
+		}
+		b, err := EncodeItem(Item{Value: value, Expires: now.Add(expiration), Stored: now})
+		if err != nil {
+			return err
+		}
+		added = true
+		return bucket.Put([]byte(key), b)
+	})
+	if err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *BoltCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// An expired item is deleted.
+func (a *BoltCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, err := a.peek(key)
+	if err != nil {
+		return Item{}, err
+	}
+	if item.Expires.Before(a.clock.Now()) {
+		if err := a.deleteExpired(ctx, [][]byte{[]byte(key)}); err != nil {
+			return Item{}, err
+		}
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// Peek gets the item for a key, without deleting it if expired.
+func (a *BoltCache) Peek(ctx context.Context, key string) (Item, error) {
+	item, err := a.peek(key)
+	if err != nil {
+		return Item{}, err
+	}
+	if item.Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// peek reads the item for a key, expired or not.
+func (a *BoltCache) peek(key string) (Item, error) {
+	var item Item
+	var found bool
+	err := a.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		var err error
+		item, err = DecodeItem(v)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return Item{}, err
+	}
+	if !found {
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// Clean deletes expired items.
+// It collects expired keys in a read transaction, then deletes them in a
+// write transaction.
+func (a *BoltCache) Clean(ctx context.Context) error {
+	now := a.clock.Now()
+	var expired [][]byte
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			item, err := DecodeItem(v)
+			if err != nil || item.Expires.Before(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return a.deleteExpired(ctx, expired)
+}
+
+// deleteExpired deletes keys if their item is still expired or undecodable,
+// as they may have been set again since read.
+func (a *BoltCache) deleteExpired(ctx context.Context, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		now := a.clock.Now()
+		for _, k := range keys {
+			v := bucket.Get(k)
+			if v == nil {
+				continue
+			}
+			if item, err := DecodeItem(v); err == nil && !item.Expires.Before(now) {
+				continue
+			}
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes a key.
+func (a *BoltCache) Delete(ctx context.Context, key string) error {
+	return a.DeleteMulti(ctx, []string{key})
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected, in one write transaction. It returns whether the key was deleted.
+func (a *BoltCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	var deleted bool
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		item, err := DecodeItem(v)
+		if err != nil {
+			return err
+		}
+		if item.Expires.Before(a.clock.Now()) || !bytes.Equal(item.Value, expected) {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete([]byte(key))
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// DeleteMulti deletes keys.
+func (a *BoltCache) DeleteMulti(ctx context.Context, keys []string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *BoltCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+// Items have no index so they are all scanned and decoded.
+func (a *BoltCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			item, err := DecodeItem(v)
+			if err != nil || item.Meta[TagMeta] != tag {
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
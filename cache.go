@@ -13,8 +13,12 @@ Values expires strictly after provided expiration.
 package aecache
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -24,32 +28,453 @@ var (
 	ErrCacheMiss = errors.New("cache: miss")
 	// ErrTooBig is when a value is too big to fit in the cache.
 	ErrTooBig = errors.New("cache: too big")
+	// ErrNotInt is when a value read as an integer is not one.
+	ErrNotInt = errors.New("cache: not an integer")
+	// ErrNotSupported is when a layer cannot do an operation.
+	ErrNotSupported = errors.New("cache: not supported")
+	// ErrInvalidKey is when a key is rejected by WithKeyValidation.
+	ErrInvalidKey = errors.New("cache: invalid key")
 )
 
-// cacher represents the ability to set/get values and clean.
-type cacher interface {
+// An Item represents a cached value and its expiration.
+type Item struct {
+	Value   []byte
+	Expires time.Time
+	// Meta is optional metadata stored alongside the value, e.g. its
+	// Content-Type. It is nil for items stored without.
+	Meta map[string]string
+	// Stored is when the item was stored, set by layers on every write but
+	// kept when refilled from a layer to another or warmed up from a
+	// snapshot. It is zero for items stored before it was tracked.
+	Stored time.Time
+}
+
+// NewItem returns an item of a value expiring after expiration, as Set
+// stores it, on the clock of the package-level cache, see WithClock. A
+// non-positive expiration gives a zero Expires, which layers treat as
+// already expired, so SetItem stores nothing as Set would.
+func NewItem(value []byte, expiration time.Duration) Item {
+	if expiration <= 0 {
+		return Item{Value: value}
+	}
+	return Item{Value: value, Expires: getDefault().clock.Now().Add(expiration)}
+}
+
+// stamp returns an item with its Stored time set to now, unless it is copied
+// from another layer or a snapshot, see withRefill, and already has one.
+func stamp(ctx context.Context, item Item, now time.Time) Item {
+	if item.Stored.IsZero() || !isRefill(ctx) {
+		item.Stored = now
+	}
+	return item
+}
+
+// TagMeta is the Meta key of the tag of an item, which layers index to delete
+// all items sharing a tag at once with DeleteByTag, e.g. all the fragments of
+// an article. The datastore layer needs WithTags.
+const TagMeta = "aecache-tag"
+
+// EncodeItem encodes an item to bytes, for layers storing items as opaque
+// bytes. The format is a gob of Item, so an item encoded by one layer can be
+// decoded by any other. In-memory layers store Item as is, and CombinedCache
+// refills layers with Item, so nothing is re-encoded between layers.
+func EncodeItem(item Item) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeItem decodes an item encoded with EncodeItem.
+func DecodeItem(b []byte) (Item, error) {
+	var item Item
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// A ByteCache represents the ability to set/get values with an expiration,
+// for code which needs nothing more.
+type ByteCache interface {
 	// Set sets a key to a value with an expiration.
 	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
+	// Add sets a key to a value with an expiration, only if the key is not
+	// already set to a value not expired. It returns whether the key was set.
+	Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error)
 	// Get gets the value and expiration for a key.
 	Get(ctx context.Context, key string) ([]byte, time.Time, error)
+}
+
+// An ItemCache represents the ability to set/get items, with their metadata,
+// for code which needs nothing more.
+type ItemCache interface {
+	// SetItem sets a key to an item, unless it is already expired.
+	SetItem(ctx context.Context, key string, item Item) error
+	// GetItem gets the item for a key.
+	GetItem(ctx context.Context, key string) (Item, error)
+}
+
+// A Cache represents the ability to set/get values and items, and clean.
+// Every layer and wrapper of this package is a Cache, thus a ByteCache and
+// an ItemCache.
+type Cache interface {
+	ByteCache
+	ItemCache
 	// Clean deletes expired items.
 	Clean(ctx context.Context) error
+	// Delete deletes a key.
+	Delete(ctx context.Context, key string) error
+	// DeleteMulti deletes keys.
+	DeleteMulti(ctx context.Context, keys []string) error
+	// DeletePrefix deletes items whose key starts with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// DeleteByTag deletes items whose TagMeta is tag.
+	DeleteByTag(ctx context.Context, tag string) error
+}
+
+// A Namer represents a cache layer with a name, e.g. for debugging or metrics.
+type Namer interface {
+	// Name returns the name of the layer.
+	Name() string
+}
+
+// A Pinger represents a cache layer which can check its backend is healthy,
+// e.g. for readiness checks.
+type Pinger interface {
+	// Ping returns an error if the backend is not healthy.
+	Ping(ctx context.Context) error
+}
+
+// Stats holds the counters of a cache layer since its creation.
+type Stats struct {
+	Hits      uint64 // gets which found an item
+	Misses    uint64 // gets which did not
+	Evictions uint64 // items removed as expired or for capacity, not deleted
+}
+
+// A Peeker represents a cache layer which can read without writing: unlike
+// GetItem, expired items are not deleted, nor is recency updated, leaving
+// cleanup to Clean. It suits read-only consumers, e.g. without permission to
+// delete from the datastore.
+type Peeker interface {
+	// Peek gets the item for a key, without modifying the cache.
+	Peek(ctx context.Context, key string) (Item, error)
+}
+
+// A PrefixScanner represents a cache layer which can list the keys starting
+// with a prefix, e.g. for inspection.
+type PrefixScanner interface {
+	// ScanPrefix returns the keys starting with prefix, in sorted order.
+	ScanPrefix(ctx context.Context, prefix string) ([]string, error)
+}
+
+// A MultiSetter represents a cache layer which can set several items in one
+// call, e.g. under one lock.
+type MultiSetter interface {
+	// SetItemMulti sets keys to items, skipping those already expired.
+	SetItemMulti(ctx context.Context, items map[string]Item) error
+}
+
+// A MultiGetter represents a cache layer which can get several items in one
+// call, e.g. in one round trip.
+type MultiGetter interface {
+	// GetItemMulti gets the items for keys, omitting those missing or
+	// expired.
+	GetItemMulti(ctx context.Context, keys []string) (map[string]Item, error)
+}
+
+// A TTLer represents a cache layer which can report the remaining time to
+// live of several keys in one call, e.g. to refresh those about to expire.
+type TTLer interface {
+	// TTLs returns the remaining time to live of keys, omitting those
+	// missing or expired.
+	TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error)
+}
+
+// A ConditionalDeleter represents a cache layer which can delete a key only
+// if it holds an expected value, atomically, e.g. to release a Lock.
+// CombinedCache and the wrappers implement it by passing it to the layers
+// they wrap, and return ErrNotSupported if those cannot.
+type ConditionalDeleter interface {
+	// DeleteIf deletes a key only if it is set to a value not expired equal
+	// to expected. It returns whether the key was deleted.
+	DeleteIf(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// A conditional represents a cache layer which is a ConditionalDeleter only
+// if the layers it wraps are, like CombinedCache and the wrappers.
+type conditional interface {
+	canDeleteIf() bool
+}
+
+// An Invalidator represents a cache layer which keeps more than items about
+// a key, like the negative cache of NewLoadingCache, and forgets it all with
+// Invalidate. CombinedCache and the wrappers pass it to the layers they
+// wrap, so it is best called on the outermost cache.
+type Invalidator interface {
+	// Invalidate removes a key and anything remembered about it.
+	Invalidate(ctx context.Context, key string) error
+}
+
+// A Statser represents a cache layer which counts its operations, e.g. to
+// export metrics.
+type Statser interface {
+	// Stats returns the counters of the layer.
+	Stats() Stats
 }
 
-// defaultCache is the default layered cache (process memory, cloud datastore).
-var defaultCache = newCombinedCache(newMemoryCache(), newDatastoreCache())
+// peek gets the item for a key in a cache layer with Peek if it is a Peeker,
+// GetItem otherwise.
+func peek(ctx context.Context, c Cache, key string) (Item, error) {
+	if p, ok := c.(Peeker); ok {
+		return p.Peek(ctx, key)
+	}
+	return c.GetItem(ctx, key)
+}
+
+// getItemMulti gets the items for keys in a cache layer with GetItemMulti if
+// it is a MultiGetter, GetItem on each key otherwise, omitting misses.
+func getItemMulti(ctx context.Context, c Cache, keys []string) (map[string]Item, error) {
+	if m, ok := c.(MultiGetter); ok {
+		return m.GetItemMulti(ctx, keys)
+	}
+	items := make(map[string]Item)
+	for _, key := range keys {
+		item, err := c.GetItem(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[key] = item
+	}
+	return items, nil
+}
+
+// canDeleteIf tells whether a cache layer can delete a key conditionally,
+// through the layers it wraps.
+func canDeleteIf(c Cache) bool {
+	if w, ok := c.(conditional); ok {
+		return w.canDeleteIf()
+	}
+	_, ok := c.(ConditionalDeleter)
+	return ok
+}
+
+// deleteIf deletes a key in a cache layer only if it is set to expected, if
+// it is a ConditionalDeleter, otherwise it returns ErrNotSupported.
+func deleteIf(ctx context.Context, c Cache, key string, expected []byte) (bool, error) {
+	if !canDeleteIf(c) {
+		return false, ErrNotSupported
+	}
+	return c.(ConditionalDeleter).DeleteIf(ctx, key, expected)
+}
+
+// invalidate invalidates a key in a cache layer with Invalidate if it is an
+// Invalidator, Delete otherwise.
+func invalidate(ctx context.Context, c Cache, key string) error {
+	if i, ok := c.(Invalidator); ok {
+		return i.Invalidate(ctx, key)
+	}
+	return c.Delete(ctx, key)
+}
+
+// ping pings a cache layer if it is a Pinger.
+func ping(ctx context.Context, c Cache) error {
+	if p, ok := c.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// LayerName returns the name of a cache layer if it is a Namer,
+// otherwise its type name.
+func LayerName(c Cache) string {
+	if n, ok := c.(Namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+// Check at compile time that a Cache is both a ByteCache and an ItemCache.
+var (
+	_ ByteCache = Cache(nil)
+	_ ItemCache = Cache(nil)
+)
+
+// Check at compile time that the layers implement Cache, Clean included.
+var (
+	_ Cache = (*MemoryCache)(nil)
+	_ Cache = (*SyncMapCache)(nil)
+	_ Cache = (*ShardedMemoryCache)(nil)
+	_ Cache = (*RequestCache)(nil)
+	_ Cache = (*DatastoreCache)(nil)
+	_ Cache = (*ChunkedDatastoreCache)(nil)
+	_ Cache = (*BoltCache)(nil)
+	_ Cache = (*GomemcacheCache)(nil)
+	_ Cache = (*CombinedCache)(nil)
+	_ Cache = (*ReplicatedCache)(nil)
+	_ Cache = (*Router)(nil)
+	_ Cache = (*loadingCache)(nil)
+	_ Cache = (*hashedCache)(nil)
+	_ Cache = (*timedCache)(nil)
+	_ Cache = (*prefixedCache)(nil)
+	_ Cache = (*FallbackCache)(nil)
+	_ Cache = (*swrCache)(nil)
+	_ Cache = (*dedupCache)(nil)
+)
+
+// defaultCache is the layered cache used by the package-level functions,
+// by default process memory then cloud datastore.
+var (
+	defaultMu    sync.RWMutex // protects defaultCache
+	defaultCache = NewCombinedCache([]Cache{NewMemoryCache(), NewDatastoreCache()})
+)
+
+// Configure replaces the layers used by the package-level functions, fastest
+// to slowest, with options for the combined cache.
+// It must be called once at startup, before serving traffic: items in the
+// previous layers are not carried over.
+func Configure(layers []Cache, opts ...Option) {
+	c := NewCombinedCache(layers, opts...)
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultCache = c
+}
+
+// getDefault returns the cache used by the package-level functions.
+func getDefault() *CombinedCache {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultCache
+}
 
 // Set sets a key to a value with an expiration.
 func Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
-	return defaultCache.Set(ctx, key, value, expiration)
+	return getDefault().Set(ctx, key, value, expiration)
 }
 
 // Get gets the value and expiration for a key.
 func Get(ctx context.Context, key string) ([]byte, time.Time, error) {
-	return defaultCache.Get(ctx, key)
+	return getDefault().Get(ctx, key)
+}
+
+// GetOr is like Get but returns fallback, with a zero expiration, on a miss.
+// Other errors are returned.
+func GetOr(ctx context.Context, key string, fallback []byte) ([]byte, time.Time, error) {
+	value, expires, err := Get(ctx, key)
+	if err == ErrCacheMiss {
+		return fallback, time.Time{}, nil
+	}
+	return value, expires, err
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func SetItem(ctx context.Context, key string, item Item) error {
+	return getDefault().SetItem(ctx, key, item)
+}
+
+// SetItemAt sets a key to a value expiring exactly at expiresAt, unless
+// already expired.
+func SetItemAt(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	return getDefault().SetItemAt(ctx, key, value, expiresAt)
+}
+
+// GetItem gets the item for a key.
+func GetItem(ctx context.Context, key string) (Item, error) {
+	return getDefault().GetItem(ctx, key)
+}
+
+// GetItemOr is like GetItem but returns fallback on a miss.
+// Other errors are returned.
+func GetItemOr(ctx context.Context, key string, fallback Item) (Item, error) {
+	item, err := GetItem(ctx, key)
+	if err == ErrCacheMiss {
+		return fallback, nil
+	}
+	return item, err
+}
+
+// Peek gets the item for a key without modifying the cache layers.
+func Peek(ctx context.Context, key string) (Item, error) {
+	return getDefault().Peek(ctx, key)
+}
+
+// GetItemFallback gets the item of the first key found, trying keys in
+// order, and returns which key matched.
+func GetItemFallback(ctx context.Context, keys ...string) (Item, string, error) {
+	return getDefault().GetItemFallback(ctx, keys...)
+}
+
+// GetItemMaxAge gets the item for a key stored at most maxAge ago.
+func GetItemMaxAge(ctx context.Context, key string, maxAge time.Duration) (Item, error) {
+	return getDefault().GetItemMaxAge(ctx, key, maxAge)
+}
+
+// GetItemIfNewer gets the item for a key if it was stored after since.
+func GetItemIfNewer(ctx context.Context, key string, since time.Time) (Item, bool, error) {
+	return getDefault().GetItemIfNewer(ctx, key, since)
+}
+
+// GetRefreshing gets the item for a key and, when it expires in less than
+// threshold, refreshes it in the background with the loader.
+func GetRefreshing(ctx context.Context, key string, threshold time.Duration, loader Loader) (Item, error) {
+	return getDefault().GetRefreshing(ctx, key, threshold, loader)
+}
+
+// PreloadFromDatastore populates the fastest layer with up to limit of the
+// latest items of the datastore.
+func PreloadFromDatastore(ctx context.Context, limit int) error {
+	return getDefault().PreloadFromDatastore(ctx, limit)
+}
+
+// Ping checks the cache layers are healthy.
+func Ping(ctx context.Context) error {
+	return getDefault().Ping(ctx)
+}
+
+// Shutdown stops writes, sets pending refills and closes the cache layers.
+func Shutdown(ctx context.Context) error {
+	return getDefault().Shutdown(ctx)
 }
 
 // Clean deletes expired items.
 func Clean(ctx context.Context) error {
-	return defaultCache.Clean(ctx)
+	return getDefault().Clean(ctx)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func DeletePrefix(ctx context.Context, prefix string) error {
+	return getDefault().DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func DeleteByTag(ctx context.Context, tag string) error {
+	return getDefault().DeleteByTag(ctx, tag)
+}
+
+// Delete deletes a key.
+func Delete(ctx context.Context, key string) error {
+	return getDefault().Delete(ctx, key)
+}
+
+// Invalidate removes a key from every cache layer, see
+// CombinedCache.Invalidate. It is the canonical way to invalidate a key
+// after writing its source of truth.
+func Invalidate(ctx context.Context, key string) error {
+	return getDefault().Invalidate(ctx, key)
+}
+
+// DeleteMulti deletes keys.
+func DeleteMulti(ctx context.Context, keys []string) error {
+	return getDefault().DeleteMulti(ctx, keys)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return getDefault().Add(ctx, key, value, expiration)
 }
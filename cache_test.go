@@ -0,0 +1,87 @@
+package aecache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// held tells whether a layer still stores a key, expired or not.
+func held(ctx context.Context, c Cache, key string) bool {
+	switch a := c.(type) {
+	case *MemoryCache:
+		a.m.Lock()
+		defer a.m.Unlock()
+		_, ok := a.items[key]
+		return ok
+	case *SyncMapCache:
+		_, ok := a.items.Load(key)
+		return ok
+	case *ShardedMemoryCache:
+		return held(ctx, a.shard(key), key)
+	case *RequestCache:
+		_, ok := a.items(ctx)[key]
+		return ok
+	case *BoltCache:
+		_, err := a.peek(key)
+		return err == nil
+	case *CombinedCache:
+		for _, e := range a.caches {
+			if held(ctx, e, key) {
+				return true
+			}
+		}
+		return false
+	}
+	panic("held: unknown layer " + LayerName(c))
+}
+
+// TestClean checks every in-process layer collects expired items with Clean,
+// and that CombinedCache fans it out to its layers.
+func TestClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	bolt, err := NewBoltCache(filepath.Join(dir, "bolt.db"), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	for _, tt := range []struct {
+		name string
+		c    Cache
+	}{
+		{"memory", NewMemoryCache(WithClock(clock))},
+		{"syncmap", NewSyncMapCache(WithClock(clock))},
+		{"sharded", NewShardedMemoryCache(4, WithClock(clock))},
+		{"request", NewRequestCache(WithClock(clock))},
+		{"bolt", bolt},
+		{"combined", NewCombinedCache([]Cache{
+			NewMemoryCache(WithClock(clock)),
+			NewSyncMapCache(WithClock(clock)),
+		}, WithClock(clock))},
+	} {
+		c := tt.c
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithRequestCache(context.Background())
+			c.Set(ctx, "short", []byte("v"), time.Minute)
+			c.Set(ctx, "long", []byte("v"), time.Hour)
+			clock.advance(2 * time.Minute)
+			if err := c.Clean(ctx); err != nil {
+				t.Fatalf("Clean() = %v", err)
+			}
+			if held(ctx, c, "short") {
+				t.Errorf("expired item still held after Clean")
+			}
+			if !held(ctx, c, "long") {
+				t.Errorf("live item not held after Clean")
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package aecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// castagnoli is the CRC-32C table, accelerated in hardware on most CPUs.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C of b, big-endian.
+func checksum(b []byte) []byte {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(b, castagnoli))
+	return sum
+}
+
+// corrupt tells whether b does not match its checksum, if any.
+func corrupt(b, sum []byte) bool {
+	return sum != nil && !bytes.Equal(sum, checksum(b))
+}
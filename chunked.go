@@ -0,0 +1,194 @@
+package aecache
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/StalkR/aecache/internal"
+)
+
+const (
+	// chunkKindSuffix is appended to the kind of items for their chunks.
+	chunkKindSuffix = "Chunk"
+	// chunksPerPut bounds chunks written per call, under the request size limit.
+	chunksPerPut = 8
+)
+
+// A ChunkedDatastoreCache represents a cache on top of Cloud Datastore which
+// splits values too big for an entity across chunk entities.
+// A chunked value is stored as a CacheItem manifest recording the number of
+// chunks, whose children of kind CacheItemChunk hold the value. Chunks have
+// the expiration of their manifest so Clean deletes them together.
+// With WithKind, chunks are of that kind suffixed with Chunk.
+// Delete only removes the manifest, its chunks are deleted by Clean once
+// expired. Add is not chunked and still rejects big values with ErrTooBig.
+type ChunkedDatastoreCache struct {
+	*DatastoreCache
+}
+
+// NewChunkedDatastoreCache creates a new ChunkedDatastoreCache.
+// It takes the options of NewDatastoreCache.
+func NewChunkedDatastoreCache(opts ...Option) *ChunkedDatastoreCache {
+	return &ChunkedDatastoreCache{NewDatastoreCache(opts...)}
+}
+
+// Set sets a key to a value with an expiration.
+func (a *ChunkedDatastoreCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+// Chunks are written before the manifest, so a reader never sees a manifest
+// without its chunks.
+func (a *ChunkedDatastoreCache) SetItem(ctx context.Context, key string, item Item) error {
+	if err := a.validate(key); err != nil {
+		return err
+	}
+	e, err := a.toCacheItem(ctx, item)
+	if err != nil {
+		return err
+	}
+	if !a.tooBig(key, e) {
+		return a.DatastoreCache.SetItem(ctx, key, item)
+	}
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "set", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	var keys []*datastore.Key
+	var chunks []*internal.CacheItem
+	for value := item.Value; len(value) > 0; {
+		ck := datastore.NameKey(a.kind+chunkKindSuffix, strconv.Itoa(len(keys)), k)
+		n := datastoreEntityLimit - datastoreEntitySize(ck, &internal.CacheItem{})
+		if n > len(value) {
+			n = len(value)
+		}
+		keys = append(keys, ck)
+		chunks = append(chunks, &internal.CacheItem{Value: value[:n], Expires: item.Expires})
+		value = value[n:]
+	}
+	for i := 0; i < len(keys); i += chunksPerPut {
+		j := i + chunksPerPut
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if _, err := a.conn().PutMulti(ctx, keys[i:j], chunks[i:j]); err != nil {
+			return a.opError(ctx, gen, "set", key, err)
+		}
+	}
+	e.Value = nil
+	e.Chunks = len(chunks)
+	if _, err := a.conn().Put(ctx, k, e); err != nil {
+		return a.opError(ctx, gen, "set", key, err)
+	}
+	return nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *ChunkedDatastoreCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key, reassembling its chunks if any.
+// Missing chunks, or chunks from another write, are a miss. A corrupt value
+// is a miss, left for Clean to delete.
+func (a *ChunkedDatastoreCache) GetItem(ctx context.Context, key string) (Item, error) {
+	if err := a.validate(key); err != nil {
+		return Item{}, err
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return Item{}, a.opError(ctx, gen, "get", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	e := internal.CacheItem{}
+	err = a.conn().Get(ctx, k, &e)
+	if err == datastore.ErrNoSuchEntity {
+		return Item{}, ErrCacheMiss
+	}
+	if err != nil {
+		return Item{}, a.opError(ctx, gen, "get", key, err)
+	}
+	if e.Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	if e.Chunks > 0 {
+		keys := make([]*datastore.Key, e.Chunks)
+		for i := range keys {
+			keys[i] = datastore.NameKey(a.kind+chunkKindSuffix, strconv.Itoa(i), k)
+		}
+		chunks := make([]internal.CacheItem, e.Chunks)
+		if err := a.conn().GetMulti(ctx, keys, chunks); err != nil {
+			if _, ok := err.(datastore.MultiError); ok {
+				return Item{}, ErrCacheMiss
+			}
+			return Item{}, a.opError(ctx, gen, "get", key, err)
+		}
+		for _, c := range chunks {
+			if !c.Expires.Equal(e.Expires) {
+				return Item{}, ErrCacheMiss
+			}
+			e.Value = append(e.Value, c.Value...)
+		}
+	}
+	if corrupt(e.Value, e.Checksum) {
+		return Item{}, ErrCacheMiss
+	}
+	item, err := fromCacheItem(&e)
+	if err != nil {
+		return Item{}, newCacheError(ctx, "get", key, err)
+	}
+	return item, nil
+}
+
+// Peek gets the item for a key, reassembling its chunks if any. It never
+// modifies the datastore, as GetItem.
+func (a *ChunkedDatastoreCache) Peek(ctx context.Context, key string) (Item, error) {
+	return a.GetItem(ctx, key)
+}
+
+// Clean deletes expired items and chunks.
+func (a *ChunkedDatastoreCache) Clean(ctx context.Context) error {
+	if err := a.DatastoreCache.Clean(ctx); err != nil {
+		return err
+	}
+	return a.clean(ctx, a.kind+chunkKindSuffix)
+}
+
+// CleanBudgeted deletes expired items then chunks within a budget, and tells
+// whether expired items or chunks may be left.
+func (a *ChunkedDatastoreCache) CleanBudgeted(ctx context.Context, budget CleanBudget) (CleanResult, error) {
+	r, err := a.cleanBudgeted(ctx, a.kind, budget)
+	if err != nil || r.More {
+		return r, err
+	}
+	// Without more items, fewer were read than any bound, so bounds left
+	// are positive.
+	if budget.MaxReads > 0 {
+		budget.MaxReads -= r.Reads
+	}
+	if budget.MaxDeletes > 0 {
+		budget.MaxDeletes -= r.Deletes
+	}
+	c, err := a.cleanBudgeted(ctx, a.kind+chunkKindSuffix, budget)
+	return CleanResult{Reads: r.Reads + c.Reads, Deletes: r.Deletes + c.Deletes, More: c.More}, err
+}
@@ -0,0 +1,54 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/StalkR/aecache/internal"
+)
+
+// TestChunkedDatastoreCache checks big values are split across chunks which
+// expire and are cleaned with their manifest. It needs the datastore
+// emulator.
+func TestChunkedDatastoreCache(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewChunkedDatastoreCache(WithClock(clock), WithChecksum(), WithKind("ChunkedCache"+strconv.FormatInt(time.Now().UnixNano(), 36)))
+	value := make([]byte, 3*MaxDatastoreValueSize)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	if err := a.Set(ctx, "big", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Delete(ctx, "big")
+	var e internal.CacheItem
+	if err := a.conn().Get(ctx, datastore.NameKey(a.kind, "big", nil), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Chunks < 3 || len(e.Value) != 0 {
+		t.Errorf("manifest has %d chunks and %d bytes; want at least 3 chunks and no value", e.Chunks, len(e.Value))
+	}
+	if got, _, err := a.Get(ctx, "big"); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Get() = %d bytes, %v; want the %d bytes set", len(got), err, len(value))
+	}
+	clock.advance(2 * time.Minute)
+	if _, _, err := a.Get(ctx, "big"); err != ErrCacheMiss {
+		t.Errorf("Get() after expiry = %v; want ErrCacheMiss", err)
+	}
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	q := datastore.NewQuery(a.kind + chunkKindSuffix).KeysOnly()
+	if keys, err := a.conn().GetAll(ctx, q, nil); err != nil || len(keys) != 0 {
+		t.Errorf("chunks left after Clean = %d, %v; want 0", len(keys), err)
+	}
+}
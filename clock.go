@@ -0,0 +1,17 @@
+package aecache
+
+import "time"
+
+// A Clock tells the current time, used to compute and check expirations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// realClock is a Clock using the system time.
+type realClock struct{}
+
+// Now returns the current system time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
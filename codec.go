@@ -0,0 +1,145 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// A Codec represents the ability to encode values to bytes and back.
+type Codec interface {
+	// Marshal encodes a value to bytes.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes bytes into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec using encoding/json.
+// Values remain readable by consumers in other languages.
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec is a Codec using encoding/gob.
+var GobCodec Codec = gobCodec{}
+
+// RawItemCodec is a Codec of items only, for WithItemCodec: it stores the
+// value as is after a header of the expiration, so values already encoded
+// are not encoded again. Meta and Stored are dropped, so a layer using it
+// loses tags, GetItemIfNewer always finds its items newer and GetItemMaxAge
+// too old.
+var RawItemCodec Codec = rawItemCodec{}
+
+// errNotItem is when RawItemCodec is given something else than an item.
+var errNotItem = errors.New("cache: raw codec only encodes items")
+
+// rawItemHeader is the size of the header of RawItemCodec: the expiration in
+// Unix nanoseconds, big-endian.
+const rawItemHeader = 8
+
+type rawItemCodec struct{}
+
+func (rawItemCodec) Marshal(v interface{}) ([]byte, error) {
+	item, ok := v.(Item)
+	if !ok {
+		return nil, errNotItem
+	}
+	b := make([]byte, rawItemHeader+len(item.Value))
+	binary.BigEndian.PutUint64(b, uint64(item.Expires.UnixNano()))
+	copy(b[rawItemHeader:], item.Value)
+	return b, nil
+}
+
+func (rawItemCodec) Unmarshal(data []byte, v interface{}) error {
+	item, ok := v.(*Item)
+	if !ok {
+		return errNotItem
+	}
+	if len(data) < rawItemHeader {
+		return errors.New("cache: raw item too short")
+	}
+	*item = Item{
+		Value:   data[rawItemHeader:],
+		Expires: time.Unix(0, int64(binary.BigEndian.Uint64(data))),
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// A CodecCache represents a cache of values encoded with a Codec.
+// Cache layers store whatever bytes the codec produces as is, so with
+// JSONCodec values in the datastore remain portable to non-Go consumers.
+type CodecCache struct {
+	Cache     Cache
+	Codec     Codec
+	version   byte // prefix of values, if versioned
+	versioned bool
+}
+
+// NewCodecCache creates a new CodecCache on top of a Cache.
+// It supports the WithSchemaVersion option.
+func NewCodecCache(cache Cache, codec Codec, opts ...Option) *CodecCache {
+	o := newOptions(opts...)
+	return &CodecCache{
+		Cache:     cache,
+		Codec:     codec,
+		version:   o.version,
+		versioned: o.versioned,
+	}
+}
+
+// SetValue encodes a value and sets a key to it with an expiration.
+func (a *CodecCache) SetValue(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	value, err := a.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if a.versioned {
+		value = append([]byte{a.version}, value...)
+	}
+	return a.Cache.Set(ctx, key, value, expiration)
+}
+
+// GetValue gets the value for a key and decodes it into v, a pointer.
+// It returns the expiration. A value of another schema version is a miss.
+func (a *CodecCache) GetValue(ctx context.Context, key string, v interface{}) (time.Time, error) {
+	value, expires, err := a.Cache.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if a.versioned {
+		if len(value) == 0 || value[0] != a.version {
+			return time.Time{}, ErrCacheMiss
+		}
+		value = value[1:]
+	}
+	if err := a.Codec.Unmarshal(value, v); err != nil {
+		return time.Time{}, err
+	}
+	return expires, nil
+}
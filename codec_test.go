@@ -0,0 +1,60 @@
+package aecache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRawItemCodec(t *testing.T) {
+	item := Item{
+		Value:   []byte("value"),
+		Expires: time.Unix(1e9, 42),
+		Meta:    map[string]string{TagMeta: "t"},
+		Stored:  time.Unix(1e9, 0),
+	}
+	b, err := RawItemCodec.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Item
+	if err := RawItemCodec.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Value, item.Value) || !got.Expires.Equal(item.Expires) {
+		t.Errorf("RawItemCodec round trip = %+v, want value and expiration of %+v", got, item)
+	}
+	if got.Meta != nil || !got.Stored.IsZero() {
+		t.Errorf("RawItemCodec kept Meta %v and Stored %v, want them dropped", got.Meta, got.Stored)
+	}
+}
+
+func BenchmarkItemCodec(b *testing.B) {
+	item := Item{
+		Value:   bytes.Repeat([]byte("v"), 100),
+		Expires: time.Now().Add(time.Hour),
+		Stored:  time.Now(),
+	}
+	for _, tt := range []struct {
+		name  string
+		codec Codec
+	}{
+		{"gob", GobCodec},
+		{"json", JSONCodec},
+		{"raw", RawItemCodec},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := tt.codec.Marshal(item)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var got Item
+				if err := tt.codec.Unmarshal(data, &got); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
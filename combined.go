@@ -1,64 +1,946 @@
 package aecache
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"log"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// A combinedCache represents the combination of multiple caches.
-type combinedCache []cacher
+// A CombinedCache represents the combination of multiple caches.
+type CombinedCache struct {
+	enqueued      uint64          // atomic, refills queued, first for alignment
+	executed      uint64          // atomic, refills written synchronously
+	dropped       uint64          // atomic, background refreshes dropped
+	caches        []Cache         // fastest to slowest
+	workers       int             // concurrent writes in Set, 0 or 1 for sequential
+	readOnly      int32           // atomic, 1 when writes are disabled
+	shutdown      int32           // atomic, 1 after Shutdown
+	refresh       flight          // refreshes in flight by GetRefreshing
+	maxTTLs       []time.Duration // per layer maximum expiration, 0 for none
+	repair        bool            // check hits against the slowest layer
+	refiller      *refiller       // batches refills, nil to refill synchronously
+	maxSizes      []int           // per layer maximum value size, 0 for none
+	maxTTL        time.Duration   // maximum expiration, 0 for none
+	logger        *log.Logger     // for background failures, nil for none
+	consistency   ConsistencyMode
+	background    chan struct{} // limits background refreshes in flight
+	onFailedWrite func(ctx context.Context, w FailedWrite)
+	required      int      // layers which must succeed in best-effort writes, 0 if not
+	promoter      Promoter // decides refills, nil to refill all items
+	clock         Clock
+}
+
+// A ConsistencyMode tells which layers a CombinedCache reads to get an item.
+type ConsistencyMode int
+
+// Consistency modes, trading latency for freshness.
+const (
+	// FirstHit returns the item of the fastest layer which has it.
+	FirstHit ConsistencyMode = iota
+	// FreshestWins reads all layers and returns the item expiring last, so
+	// a stale item in a faster layer is replaced.
+	FreshestWins
+	// Authoritative always reads the slowest layer, the source of truth.
+	Authoritative
+)
 
-// newMemoryCache creates a new combinedCache.
-func newCombinedCache(caches ...cacher) combinedCache {
-	return combinedCache(caches)
+// A FailedWrite represents a write made in the background which failed, so
+// no caller got its error.
+type FailedWrite struct {
+	Key   string
+	Item  Item
+	Layer Cache // the layer written, or the combined cache for a refresh
+	Err   error
+}
+
+// NewCombinedCache creates a new CombinedCache from caches, fastest to slowest.
+func NewCombinedCache(caches []Cache, opts ...Option) *CombinedCache {
+	o := newOptions(opts...)
+	a := &CombinedCache{
+		caches:        caches,
+		workers:       o.workers,
+		maxTTLs:       o.layerMaxTTLs,
+		repair:        o.readRepair,
+		maxSizes:      o.layerMaxSizes,
+		maxTTL:        o.maxTTL,
+		logger:        o.logger,
+		consistency:   o.consistency,
+		background:    make(chan struct{}, o.maxBackground),
+		onFailedWrite: o.onFailedWrite,
+		required:      o.bestEffort,
+		promoter:      o.promoter,
+		clock:         o.clock,
+	}
+	if o.refillBatch > 0 {
+		a.refiller = newRefiller(caches, o.refillBatch, o.refillDelay, o.logger, o.onFailedWrite)
+	}
+	return a
 }
 
 // Set sets a key to a value with an expiration.
-// It updates all caches from fastest to slowest.
-func (a combinedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
-	for _, e := range a {
-		if err := e.Set(ctx, key, value, expiration); err != nil {
-			return err
+// It updates all caches from fastest to slowest, or concurrently with workers.
+func (a *CombinedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if a.isReadOnly() {
+		return nil
+	}
+	a.forgetKeys(key)
+	if a.workers > 1 {
+		return a.setConcurrent(ctx, key, value, expiration)
+	}
+	return a.write(func(i int) error {
+		return a.set(ctx, i, key, value, expiration)
+	})
+}
+
+// write writes to all layers with f, fastest to slowest. It stops at the
+// first error, or with WithBestEffortWrites attempts all layers.
+func (a *CombinedCache) write(f func(layer int) error) error {
+	if a.required <= 0 {
+		for i := range a.caches {
+			if err := f(i); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+	errs := make([]error, len(a.caches))
+	for i := range a.caches {
+		errs[i] = f(i)
+	}
+	return a.partial(errs)
+}
+
+// partial returns the errors of a best-effort write to layers, by layer,
+// combined by layer name if a required layer failed. Otherwise the write
+// succeeded enough and errors are logged.
+func (a *CombinedCache) partial(errs []error) error {
+	var failed []error
+	var required bool
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = append(failed, fmt.Errorf("%v: %v", LayerName(a.caches[i]), err))
+		if i < a.required {
+			required = true
+		}
+	}
+	if required {
+		return combineErrors(failed)
+	}
+	if len(failed) > 0 {
+		logf(a.logger, "aecache: partial write: %v", combineErrors(failed))
 	}
 	return nil
 }
 
+// set sets a key to a value in a layer, or deletes it if the value is too
+// big for the layer.
+func (a *CombinedCache) set(ctx context.Context, layer int, key string, value []byte, expiration time.Duration) error {
+	if !a.fits(layer, len(value)) {
+		return a.caches[layer].Delete(ctx, key)
+	}
+	return a.caches[layer].Set(ctx, key, value, a.capTTL(layer, expiration))
+}
+
+// setConcurrent updates all caches concurrently, bounded by workers.
+// It attempts all caches and combines their errors, or with
+// WithBestEffortWrites, those of the required layers.
+func (a *CombinedCache) setConcurrent(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(a.caches)) // by layer, each written by one goroutine
+	sem := make(chan struct{}, a.workers)
+	for i := range a.caches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = a.set(ctx, i, key, value, expiration)
+		}(i)
+	}
+	wg.Wait()
+	if a.required > 0 {
+		return a.partial(errs)
+	}
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return combineErrors(failed)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+// It updates all caches from fastest to slowest, stopping at the first error
+// unless with WithBestEffortWrites.
+func (a *CombinedCache) SetItem(ctx context.Context, key string, item Item) error {
+	if a.isReadOnly() {
+		return nil
+	}
+	a.forgetKeys(key)
+	return a.write(func(i int) error {
+		if !a.fits(i, len(item.Value)) {
+			return a.caches[i].Delete(ctx, key)
+		}
+		return a.caches[i].SetItem(ctx, key, a.capItem(i, item))
+	})
+}
+
+// SetItemAt sets a key to a value expiring exactly at expiresAt, unless
+// already expired, e.g. at the expiry of a token it caches. Unlike Set with
+// the duration until then, no skew is introduced converting it back.
+func (a *CombinedCache) SetItemAt(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	return a.SetItem(ctx, key, Item{Value: value, Expires: expiresAt})
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+// The slowest cache decides; when added, faster caches are updated too.
+func (a *CombinedCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if len(a.caches) == 0 || a.isReadOnly() {
+		return false, nil
+	}
+	last := len(a.caches) - 1
+	added, err := a.caches[last].Add(ctx, key, value, a.capTTL(last, expiration))
+	if err != nil || !added {
+		return false, err
+	}
+	a.forgetKeys(key)
+	for i := range a.caches[:last] {
+		if err := a.set(ctx, i, key, value, expiration); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+// The slowest cache decides, atomically; when deleted, the key is deleted in
+// faster caches too. It returns ErrNotSupported if the slowest cache is not
+// a ConditionalDeleter.
+func (a *CombinedCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	if len(a.caches) == 0 {
+		return false, nil
+	}
+	last := len(a.caches) - 1
+	deleted, err := deleteIf(ctx, a.caches[last], key, expected)
+	if err != nil || !deleted {
+		return false, err
+	}
+	a.forgetKeys(key)
+	var errs []error
+	for _, e := range a.caches[:last] {
+		if err := e.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return true, combineErrors(errs)
+}
+
+// canDeleteIf tells whether the slowest cache can delete conditionally.
+func (a *CombinedCache) canDeleteIf() bool {
+	return len(a.caches) > 0 && canDeleteIf(a.caches[len(a.caches)-1])
+}
+
 // Get gets the value and expiration for a key.
 // It looks through all the cache layers, from fastest to slowest.
 // When found, a layer refreshes its parent caches.
-func (a combinedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
-	if len(a) == 0 {
-		return nil, time.Time{}, ErrCacheMiss
+func (a *CombinedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, _, err := a.get(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
-	value, expires, err := a[0].Get(ctx, key)
-	if err == nil {
-		return value, expires, nil
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// It looks through all the cache layers, from fastest to slowest.
+// When found, a layer refreshes its parent caches.
+func (a *CombinedCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, _, err := a.get(ctx, key)
+	return item, err
+}
+
+// GetFrom is like GetItem but also returns the name of the layer which had
+// the item, see LayerName.
+func (a *CombinedCache) GetFrom(ctx context.Context, key string) (Item, string, error) {
+	item, i, err := a.get(ctx, key)
+	if err != nil {
+		return Item{}, "", err
 	}
-	if err != ErrCacheMiss {
-		return nil, time.Time{}, err
+	return item, LayerName(a.caches[i]), nil
+}
+
+// Peek gets the item for a key without modifying the caches: it looks
+// through all the cache layers, from fastest to slowest, with Peek for those
+// which are a Peeker, GetItem otherwise, and does not refresh faster caches.
+func (a *CombinedCache) Peek(ctx context.Context, key string) (Item, error) {
+	for _, e := range a.caches {
+		item, err := peek(ctx, e, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		return item, err
+	}
+	return Item{}, ErrCacheMiss
+}
+
+// Prefetch refills the faster layers with the item for a key from the slower
+// layers, e.g. when a hot item was evicted from memory, see WithOnEvictHot.
+// It returns ErrCacheMiss if no slower layer has the item.
+func (a *CombinedCache) Prefetch(ctx context.Context, key string) error {
+	for i := 1; i < len(a.caches); i++ {
+		item, err := a.caches[i].GetItem(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for j := i - 1; j >= 0; j-- {
+			if !a.fits(j, len(item.Value)) {
+				continue
+			}
+			if err := a.caches[j].SetItem(withRefill(ctx), key, a.capItem(j, item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrCacheMiss
+}
+
+// GetItemMulti gets the items for keys, omitting those missing or expired: it
+// looks up the keys still missing in each layer, from fastest to slowest, in
+// one call to layers which are a MultiGetter. Items found refill the faster
+// layers as GetItem. Outside FirstHit or with WithReadRepair, keys are looked
+// up one at a time as GetItem does.
+func (a *CombinedCache) GetItemMulti(ctx context.Context, keys []string) (map[string]Item, error) {
+	items := make(map[string]Item)
+	if a.consistency != FirstHit || a.repair {
+		for _, key := range keys {
+			item, _, err := a.get(ctx, key)
+			if err == ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[key] = item
+		}
+		return items, nil
+	}
+	missing := keys
+	for i, e := range a.caches {
+		if len(missing) == 0 {
+			break
+		}
+		found, err := getItemMulti(ctx, e, missing)
+		if err != nil {
+			return nil, err
+		}
+		var rest []string
+		for _, key := range missing {
+			item, ok := found[key]
+			if !ok {
+				rest = append(rest, key)
+				continue
+			}
+			if _, ok := items[key]; ok {
+				continue
+			}
+			if err := a.refill(ctx, key, item, i); err != nil {
+				return nil, err
+			}
+			items[key] = item
+		}
+		missing = rest
+	}
+	return items, nil
+}
+
+// GetItemFallback gets the item of the first key found, trying keys in
+// order, each through all the cache layers, and returns which key matched,
+// e.g. to fall back to the key of a previous version. A key found refreshes
+// its parent caches as GetItem. It returns ErrCacheMiss if no key is found,
+// and stops at the first other error.
+func (a *CombinedCache) GetItemFallback(ctx context.Context, keys ...string) (Item, string, error) {
+	for _, key := range keys {
+		item, _, err := a.get(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return Item{}, "", err
+		}
+		return item, key, nil
+	}
+	return Item{}, "", ErrCacheMiss
+}
+
+// GetItemIfNewer gets the item for a key and returns true if it was stored
+// after since, otherwise false and no item, e.g. for an HTTP handler to reply
+// 304 Not Modified to If-Modified-Since. As HTTP dates, since is compared to
+// Stored truncated to the second. Items without Stored are always newer.
+func (a *CombinedCache) GetItemIfNewer(ctx context.Context, key string, since time.Time) (Item, bool, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return Item{}, false, err
+	}
+	if !item.Stored.IsZero() && !item.Stored.Truncate(time.Second).After(since) {
+		return Item{}, false, nil
+	}
+	return item, true, nil
+}
+
+// GetRefreshing gets the item for a key and, when it expires in less than
+// threshold, refreshes it in the background with the loader, while the still
+// valid item is returned. Only one refresh per key runs at a time, and at
+// most WithMaxBackground in total: beyond, refreshes are skipped.
+// On a miss, the item is loaded and stored.
+func (a *CombinedCache) GetRefreshing(ctx context.Context, key string, threshold time.Duration, loader Loader) (Item, error) {
+	item, err := a.GetItem(ctx, key)
+	if err == ErrCacheMiss {
+		return a.load(ctx, key, loader, false)
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	if item.Expires.Sub(a.clock.Now()) < threshold {
+		select {
+		case a.background <- struct{}{}:
+			go func() {
+				defer func() { <-a.background }()
+				if _, err := a.load(context.Background(), key, loader, true); err != nil {
+					logf(a.logger, "aecache: refreshing %q: %v", key, err)
+				}
+			}()
+		default:
+			// Saturated: the item is still valid, a later get refreshes it.
+			atomic.AddUint64(&a.dropped, 1)
+		}
+	}
+	return item, nil
+}
+
+// load loads and stores the item for a key, one load per key at a time.
+// In the background, failures to store are reported as failed writes.
+func (a *CombinedCache) load(ctx context.Context, key string, loader Loader, background bool) (Item, error) {
+	return a.refresh.Do(key, func() (Item, error) {
+		item, err := loader(ctx, key)
+		if err != nil {
+			return Item{}, err
+		}
+		if err := a.SetItem(ctx, key, item); err != nil {
+			if background && a.onFailedWrite != nil {
+				a.onFailedWrite(ctx, FailedWrite{Key: key, Item: item, Layer: a, Err: err})
+			}
+			return Item{}, err
+		}
+		return item, nil
+	})
+}
+
+// get gets the item for a key, and the index of the layer which had it,
+// then refills the faster layers.
+func (a *CombinedCache) get(ctx context.Context, key string) (Item, int, error) {
+	item, i, err := a.lookup(ctx, key)
+	if err != nil {
+		return Item{}, 0, err
+	}
+	if err := a.refill(ctx, key, item, i); err != nil {
+		return Item{}, 0, err
+	}
+	return item, i, nil
+}
+
+// refill sets an item found in layer i in the faster layers.
+func (a *CombinedCache) refill(ctx context.Context, key string, item Item, i int) error {
+	if a.isReadOnly() || i > 0 && a.promoter != nil && !a.promoter.Promote(key, item) {
+		return nil
+	}
+	for j := i - 1; j >= 0; j-- {
+		if !a.fits(j, len(item.Value)) {
+			continue
+		}
+		atomic.AddUint64(&a.enqueued, 1)
+		if a.refiller != nil {
+			a.refiller.add(j, key, a.capItem(j, item))
+			continue
+		}
+		atomic.AddUint64(&a.executed, 1)
+		if err := a.caches[j].SetItem(withRefill(ctx), key, a.capItem(j, item)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetItemMaxAge gets the item for a key stored at most maxAge ago: a staler
+// item in a faster layer is skipped for a slower layer, and the item found
+// refills the faster layers. Items without Stored are too stale, and so is a
+// stale item in the slowest layer, a miss. It serves consumers which need
+// fresh items, while others use GetItem on the same keys.
+func (a *CombinedCache) GetItemMaxAge(ctx context.Context, key string, maxAge time.Duration) (Item, error) {
+	now := a.clock.Now()
+	for i, e := range a.caches {
+		item, err := e.GetItem(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return Item{}, err
+		}
+		if item.Stored.IsZero() || now.Sub(item.Stored) > maxAge {
+			continue
+		}
+		if err := a.refill(ctx, key, item, i); err != nil {
+			return Item{}, err
+		}
+		return item, nil
 	}
-	value, expires, err = combinedCache(a[1:]).Get(ctx, key)
-	if err == nil {
-		if err := a[0].Set(ctx, key, value, expires.Sub(time.Now())); err != nil {
-			return nil, time.Time{}, err
+	return Item{}, ErrCacheMiss
+}
+
+// lookup gets the item for a key, and the index of the layer which had it,
+// according to the consistency mode.
+func (a *CombinedCache) lookup(ctx context.Context, key string) (Item, int, error) {
+	switch a.consistency {
+	case Authoritative:
+		if len(a.caches) == 0 {
+			return Item{}, 0, ErrCacheMiss
 		}
+		last := len(a.caches) - 1
+		item, err := a.caches[last].GetItem(ctx, key)
+		if err != nil {
+			return Item{}, 0, err
+		}
+		return item, last, nil
+	case FreshestWins:
+		var found Item
+		index := -1
+		for i, e := range a.caches {
+			item, err := e.GetItem(ctx, key)
+			if err == ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				return Item{}, 0, err
+			}
+			if index < 0 || item.Expires.After(found.Expires) {
+				found, index = item, i
+			}
+		}
+		if index < 0 {
+			return Item{}, 0, ErrCacheMiss
+		}
+		return found, index, nil
+	}
+	for i, e := range a.caches {
+		item, err := e.GetItem(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return Item{}, 0, err
+		}
+		if a.repair && i < len(a.caches)-1 {
+			item, i = a.readRepair(ctx, key, item, i)
+		}
+		return item, i, nil
+	}
+	return Item{}, 0, ErrCacheMiss
+}
+
+// readRepair returns the item in the slowest layer and its index if the item
+// found in layer i is stale, otherwise the item found. It is best-effort: on
+// error or miss in the slowest layer, the item found is returned.
+func (a *CombinedCache) readRepair(ctx context.Context, key string, item Item, i int) (Item, int) {
+	last := len(a.caches) - 1
+	slow, err := a.caches[last].GetItem(ctx, key)
+	if err != nil {
+		return item, i
+	}
+	capped := i < len(a.maxTTLs) && a.maxTTLs[i] > 0
+	if !bytes.Equal(slow.Value, item.Value) || !capped && slow.Expires.After(item.Expires) {
+		return slow, last
 	}
-	return value, expires, err
+	return item, i
+}
+
+// fits tells whether a value of size n fits in a layer.
+func (a *CombinedCache) fits(layer int, n int) bool {
+	return layer >= len(a.maxSizes) || a.maxSizes[layer] <= 0 || n <= a.maxSizes[layer]
+}
+
+// layerMaxTTL returns the maximum expiration of a layer, 0 for none.
+func (a *CombinedCache) layerMaxTTL(layer int) time.Duration {
+	max := a.maxTTL
+	if layer < len(a.maxTTLs) && a.maxTTLs[layer] > 0 && (max <= 0 || a.maxTTLs[layer] < max) {
+		max = a.maxTTLs[layer]
+	}
+	return max
+}
+
+// capTTL caps an expiration to the maximum of a layer, if any.
+func (a *CombinedCache) capTTL(layer int, expiration time.Duration) time.Duration {
+	if max := a.layerMaxTTL(layer); max > 0 && expiration > max {
+		return max
+	}
+	return expiration
+}
+
+// capItem caps the expiration of an item to the maximum of a layer, if any.
+func (a *CombinedCache) capItem(layer int, item Item) Item {
+	if max := a.layerMaxTTL(layer); max > 0 {
+		if t := a.clock.Now().Add(max); item.Expires.After(t) {
+			item.Expires = t
+		}
+	}
+	return item
+}
+
+// SetReadOnly enables or disables writes: when read-only, Set and Add do
+// nothing and Get does not refresh faster caches, but reads still go through
+// all caches. It can be toggled at runtime, e.g. during a backend incident.
+func (a *CombinedCache) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&a.readOnly, v)
+}
+
+// isReadOnly tells whether writes are disabled, also after Shutdown.
+func (a *CombinedCache) isReadOnly() bool {
+	return atomic.LoadInt32(&a.readOnly) == 1 || atomic.LoadInt32(&a.shutdown) == 1
+}
+
+// A closer represents a cache layer holding resources, like BoltCache.
+type closer interface {
+	Close() error
+}
+
+// Shutdown stops accepting writes, sets pending refills in their layer,
+// then closes the layers holding resources, like a BoltCache file or a
+// DatastoreCache client. It can be called from a signal handler, e.g. on
+// SIGTERM, with a context bounding how long to wait for pending refills.
+// The cache must not be used afterwards.
+func (a *CombinedCache) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.shutdown, 1)
+	if a.refiller != nil {
+		done := make(chan struct{})
+		go func() {
+			a.refiller.flush()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var errs []error
+	for _, e := range a.caches {
+		if c, ok := e.(closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+			}
+		}
+	}
+	return combineErrors(errs)
+}
+
+// CombinedStats holds the stats of the layers of a CombinedCache.
+type CombinedStats struct {
+	// Layers holds the stats of the layers which are a Statser, by name,
+	// suffixed with their index if several layers have the same name.
+	Layers map[string]Stats
+	// HitRatio is the ratio of gets hit in the fastest layer, which all gets
+	// go through, so the share of gets it offloads from slower layers. It is
+	// 0 if the fastest layer is not a Statser or had no gets.
+	HitRatio float64
+	// Refills holds the counters of refills of faster layers.
+	Refills RefillStats
+}
+
+// A RefillStats holds the counters of refills of the faster layers of a
+// CombinedCache, to tell a fastest layer failing to warm because refills are
+// saturated from one churning.
+type RefillStats struct {
+	// Pending is the number of refills batched by WithRefillBatch not yet
+	// written, 0 without.
+	Pending int
+	// Enqueued counts refills of a layer, one per layer refilled.
+	Enqueued uint64
+	// Executed counts refills written, successfully or not. A refill
+	// batched while one of the same key is pending replaces it, so it may
+	// be less than Enqueued minus Pending.
+	Executed uint64
+	// Background is the number of refreshes of GetRefreshing in flight.
+	Background int
+	// Dropped counts refreshes of GetRefreshing skipped, as WithMaxBackground
+	// of them were in flight.
+	Dropped uint64
+}
+
+// Stats returns the stats of the layers, skipping those not a Statser, and
+// of its refills.
+func (a *CombinedCache) Stats() CombinedStats {
+	stats := CombinedStats{Layers: make(map[string]Stats)}
+	stats.Refills = RefillStats{
+		Enqueued:   atomic.LoadUint64(&a.enqueued),
+		Executed:   atomic.LoadUint64(&a.executed),
+		Background: len(a.background),
+		Dropped:    atomic.LoadUint64(&a.dropped),
+	}
+	if a.refiller != nil {
+		stats.Refills.Pending = a.refiller.depth()
+		stats.Refills.Executed += atomic.LoadUint64(&a.refiller.executed)
+	}
+	for i, e := range a.caches {
+		s, ok := e.(Statser)
+		if !ok {
+			continue
+		}
+		layer := s.Stats()
+		name := LayerName(e)
+		if _, ok := stats.Layers[name]; ok {
+			name = fmt.Sprintf("%v#%d", name, i)
+		}
+		stats.Layers[name] = layer
+		if i == 0 && layer.Hits+layer.Misses > 0 {
+			stats.HitRatio = float64(layer.Hits) / float64(layer.Hits+layer.Misses)
+		}
+	}
+	return stats
 }
 
 // Clean deletes expired items.
-func (a combinedCache) Clean(ctx context.Context) error {
-	var errors []string
-	for _, e := range a {
+// It attempts all caches and combines their errors, by layer name.
+func (a *CombinedCache) Clean(ctx context.Context) error {
+	var errs []error
+	for _, e := range a.caches {
 		if err := e.Clean(ctx); err != nil {
-			errors = append(errors, err.Error())
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// Ping checks all cache layers are healthy and combines their errors.
+func (a *CombinedCache) Ping(ctx context.Context) error {
+	var errs []error
+	for _, e := range a.caches {
+		if err := ping(ctx, e); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
 		}
 	}
-	if len(errors) > 0 {
-		return fmt.Errorf("cache: %v error(s)\n%v", len(errors), strings.Join(errors, "\n"))
+	return combineErrors(errs)
+}
+
+// combineErrors combines errors into one, or nil if there are none.
+func combineErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	var errors []string
+	for _, err := range errs {
+		errors = append(errors, err.Error())
+	}
+	return fmt.Errorf("cache: %v error(s)\n%v", len(errors), strings.Join(errors, "\n"))
+}
+
+// Delete deletes a key in all caches.
+// It does not stop at the first error but attempts all caches, so a backend
+// down does not leave the others stale, and combines their errors by layer
+// name.
+func (a *CombinedCache) Delete(ctx context.Context, key string) error {
+	a.forgetKeys(key)
+	var errs []error
+	for _, e := range a.caches {
+		if err := e.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// Invalidate removes a key from every cache, with Invalidate for those which
+// are an Invalidator, so from negative caches such as NewLoadingCache keeps
+// as a layer. It is the canonical way to invalidate a key after writing its
+// source of truth. Like Delete, it attempts all caches and combines their
+// errors. It returns nil if the key was absent everywhere.
+// A NewLoadingCache wrapping the combined cache is not reached: call
+// Invalidate on it instead, it is an Invalidator.
+func (a *CombinedCache) Invalidate(ctx context.Context, key string) error {
+	a.forgetKeys(key)
+	var errs []error
+	for _, e := range a.caches {
+		if err := invalidate(ctx, e, key); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// DeleteMulti deletes keys in all caches.
+// Like Delete, it attempts all caches and combines their errors.
+func (a *CombinedCache) DeleteMulti(ctx context.Context, keys []string) error {
+	a.forgetKeys(keys...)
+	var errs []error
+	for _, e := range a.caches {
+		if err := e.DeleteMulti(ctx, keys); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// DeletePrefix deletes items whose key starts with prefix in all caches.
+// Like Delete, it attempts all caches and combines their errors, so a layer
+// which cannot, like memcache, does not leave the others stale.
+func (a *CombinedCache) DeletePrefix(ctx context.Context, prefix string) error {
+	a.forget(func(key string, item Item) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	var errs []error
+	for _, e := range a.caches {
+		if err := e.DeletePrefix(ctx, prefix); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag in all caches.
+// Like Delete, it attempts all caches and combines their errors.
+func (a *CombinedCache) DeleteByTag(ctx context.Context, tag string) error {
+	a.forget(func(key string, item Item) bool {
+		return item.Meta[TagMeta] == tag
+	})
+	var errs []error
+	for _, e := range a.caches {
+		if err := e.DeleteByTag(ctx, tag); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// forget drops the queued refills of keys matching f, see WithRefillBatch,
+// so they do not overwrite a later write or delete.
+func (a *CombinedCache) forget(f func(key string, item Item) bool) {
+	if a.refiller != nil {
+		a.refiller.forget(f)
+	}
+}
+
+// forgetKeys drops the queued refills of keys.
+func (a *CombinedCache) forgetKeys(keys ...string) {
+	if a.refiller == nil {
+		return
+	}
+	set := keySet(keys)
+	a.refiller.forget(func(key string, item Item) bool {
+		_, ok := set[key]
+		return ok
+	})
+}
+
+// ScanPrefix returns the keys starting with prefix in the layers which are
+// a PrefixScanner, merged and de-duplicated, in sorted order.
+func (a *CombinedCache) ScanPrefix(ctx context.Context, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, e := range a.caches {
+		s, ok := e.(PrefixScanner)
+		if !ok {
+			continue
+		}
+		layer, err := s.ScanPrefix(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range layer {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// WarmUp populates the fastest layer from a snapshot of items,
+// skipping those already expired.
+// It can be used on startup to reload a hot set saved by Snapshot.
+func (a *CombinedCache) WarmUp(ctx context.Context, items map[string]Item) error {
+	if len(a.caches) == 0 {
+		return nil
+	}
+	return warmUp(ctx, a.caches[0], items)
+}
+
+// WarmUpAll is like WarmUp but populates all layers.
+func (a *CombinedCache) WarmUpAll(ctx context.Context, items map[string]Item) error {
+	return warmUp(ctx, a, items)
+}
+
+// A latester represents a cache layer which can list its latest items, like
+// DatastoreCache.
+type latester interface {
+	Latest(ctx context.Context, limit int) (map[string]Item, error)
+}
+
+// PreloadFromDatastore populates the fastest layer with up to limit of the
+// latest items of the first layer which can list them, like DatastoreCache,
+// to warm up a new instance from shared state. Items which do not fit the
+// fastest layer are skipped, and it evicts as usual to stay in its limits.
+func (a *CombinedCache) PreloadFromDatastore(ctx context.Context, limit int) error {
+	if len(a.caches) == 0 {
+		return nil
+	}
+	for _, e := range a.caches[1:] {
+		l, ok := e.(latester)
+		if !ok {
+			continue
+		}
+		items, err := l.Latest(ctx, limit)
+		if err != nil {
+			return err
+		}
+		for key, item := range items {
+			if !a.fits(0, len(item.Value)) {
+				continue
+			}
+			if err := a.caches[0].SetItem(withRefill(ctx), key, a.capItem(0, item)); err != nil && err != ErrTooBig {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrNotSupported
+}
+
+// warmUp sets items in a cache, skipping those already expired, keeping
+// their Stored time.
+func warmUp(ctx context.Context, c Cache, items map[string]Item) error {
+	ctx = withRefill(ctx)
+	for key, item := range items {
+		if err := c.SetItem(ctx, key, item); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,191 @@
+package aecache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// twoLayers returns a combined cache of two memory layers with a consistency
+// mode, the fast layer set to "fast" for an hour and the slow one to "slow"
+// for two.
+func twoLayers(t *testing.T, clock Clock, mode ConsistencyMode) (c *CombinedCache, fast, slow *MemoryCache) {
+	ctx := context.Background()
+	fast = NewMemoryCache(WithClock(clock))
+	slow = NewMemoryCache(WithClock(clock))
+	if err := fast.Set(ctx, "k", []byte("fast"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := slow.Set(ctx, "k", []byte("slow"), 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return NewCombinedCache([]Cache{fast, slow}, WithClock(clock), WithConsistency(mode)), fast, slow
+}
+
+func TestCombinedCacheConsistency(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		mode ConsistencyMode
+		want string
+	}{
+		{FirstHit, "fast"},
+		{FreshestWins, "slow"},
+		{Authoritative, "slow"},
+	} {
+		c, fast, _ := twoLayers(t, newFakeClock(), tt.mode)
+		item, err := c.GetItem(ctx, "k")
+		if err != nil || string(item.Value) != tt.want {
+			t.Errorf("mode %v: GetItem() = %q, %v; want %q", tt.mode, item.Value, err, tt.want)
+			continue
+		}
+		if item, err := fast.Peek(ctx, "k"); err != nil || string(item.Value) != tt.want {
+			t.Errorf("mode %v: fast layer = %q, %v; want refilled with %q", tt.mode, item.Value, err, tt.want)
+		}
+	}
+}
+
+func TestCombinedCacheFreshestWinsExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	c, fast, slow := twoLayers(t, clock, FreshestWins)
+	// Once the slow item is deleted, the fast one is the freshest left.
+	slow.Delete(ctx, "k")
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "fast" {
+		t.Errorf("GetItem() = %q, %v; want fast", item.Value, err)
+	}
+	clock.advance(90 * time.Minute)
+	if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss {
+		t.Errorf("GetItem() after expiry = %v, want ErrCacheMiss", err)
+	}
+	if fast.Len() != 0 {
+		t.Errorf("expired item left in the fast layer")
+	}
+}
+
+func TestCombinedCacheAuthoritativeMiss(t *testing.T) {
+	ctx := context.Background()
+	c, _, slow := twoLayers(t, newFakeClock(), Authoritative)
+	slow.Delete(ctx, "k")
+	if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss {
+		t.Errorf("GetItem() = %v, want ErrCacheMiss despite the fast layer", err)
+	}
+}
+
+func TestCombinedCacheNoLayers(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []ConsistencyMode{FirstHit, FreshestWins, Authoritative} {
+		c := NewCombinedCache(nil, WithConsistency(mode))
+		if _, _, err := c.Get(ctx, "k"); err != ErrCacheMiss {
+			t.Errorf("mode %v: Get() = %v, want ErrCacheMiss", mode, err)
+		}
+	}
+}
+
+// multiGetter is a cache layer which counts calls to GetItemMulti.
+type multiGetter struct {
+	*MemoryCache
+	calls int
+}
+
+func (m *multiGetter) GetItemMulti(ctx context.Context, keys []string) (map[string]Item, error) {
+	m.calls++
+	return getItemMulti(ctx, m.MemoryCache, keys)
+}
+
+func TestCombinedCacheGetItemMulti(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fast := NewMemoryCache(WithClock(clock))
+	slow := &multiGetter{MemoryCache: NewMemoryCache(WithClock(clock))}
+	c := NewCombinedCache([]Cache{fast, slow}, WithClock(clock))
+	fast.Set(ctx, "a", []byte("fast"), time.Hour)
+	slow.Set(ctx, "a", []byte("slow"), time.Hour)
+	slow.Set(ctx, "b", []byte("slow"), time.Hour)
+	slow.Set(ctx, "c", []byte("slow"), time.Minute)
+	clock.advance(2 * time.Minute)
+	items, err := c.GetItemMulti(ctx, []string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items["a"].Value) != "fast" || string(items["b"].Value) != "slow" {
+		t.Errorf("GetItemMulti() = %v; want a from fast, b from slow", items)
+	}
+	if slow.calls != 1 {
+		t.Errorf("slow layer GetItemMulti called %d times; want 1", slow.calls)
+	}
+	if got := cached(fast, "a", "b", "c", "d"); len(got) != 2 || !got["a"] || !got["b"] {
+		t.Errorf("fast layer has %v; want a and b refilled", got)
+	}
+}
+
+func TestCombinedCacheReadRepair(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fast := NewMemoryCache(WithClock(clock))
+	slow := NewMemoryCache(WithClock(clock))
+	c := NewCombinedCache([]Cache{fast, slow}, WithClock(clock), WithReadRepair())
+	fast.Set(ctx, "k", []byte("old"), time.Hour)
+	slow.Set(ctx, "k", []byte("new"), 2*time.Hour)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "new" {
+		t.Errorf("GetItem() = %q, %v; want new from the slowest layer", item.Value, err)
+	}
+	if item, err := fast.Peek(ctx, "k"); err != nil || string(item.Value) != "new" || !item.Expires.Equal(clock.Now().Add(2*time.Hour)) {
+		t.Errorf("fast layer = %q expiring %v, %v; want repaired", item.Value, item.Expires, err)
+	}
+	// A faster item of the same value expiring sooner is stale as well.
+	fast.Set(ctx, "k", []byte("new"), time.Minute)
+	c.GetItem(ctx, "k")
+	if item, _ := fast.Peek(ctx, "k"); !item.Expires.Equal(clock.Now().Add(2 * time.Hour)) {
+		t.Errorf("fast layer expires %v; want repaired to the slowest expiration", item.Expires)
+	}
+}
+
+func TestCombinedCacheReadRepairCapped(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fast := NewMemoryCache(WithClock(clock))
+	slow := NewMemoryCache(WithClock(clock))
+	c := NewCombinedCache([]Cache{fast, slow}, WithClock(clock), WithReadRepair(), WithLayerMaxTTLs(time.Minute, 0))
+	if err := c.Set(ctx, "k", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// In a capped layer, expiring sooner than the slowest layer is expected.
+	if _, i, err := c.get(ctx, "k"); err != nil || i != 0 {
+		t.Errorf("get() = layer %d, %v; want a hit in the capped fast layer", i, err)
+	}
+	clock.advance(2 * time.Minute)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "v" {
+		t.Errorf("GetItem() after the cap = %q, %v; want v from the slow layer", item.Value, err)
+	}
+	if item, err := fast.Peek(ctx, "k"); err != nil || !item.Expires.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("fast layer expires %v, %v; want refilled capped to a minute", item.Expires, err)
+	}
+}
+
+func TestCombinedCacheRefillBatch(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fast := NewMemoryCache(WithClock(clock))
+	slow := NewMemoryCache(WithClock(clock))
+	c := NewCombinedCache([]Cache{fast, slow}, WithClock(clock), WithRefillBatch(2, time.Hour))
+	for _, key := range []string{"a", "b", "c"} {
+		slow.Set(ctx, key, []byte(key), time.Hour)
+	}
+	c.GetItem(ctx, "a")
+	if got := cached(fast, "a"); len(got) != 0 || c.refiller.depth() != 1 {
+		t.Errorf("fast layer has %v with %d refills pending; want a queued", got, c.refiller.depth())
+	}
+	// A full batch is set at once.
+	c.GetItem(ctx, "b")
+	if got := cached(fast, "a", "b"); len(got) != 2 || c.refiller.depth() != 0 {
+		t.Errorf("fast layer has %v with %d refills pending; want a and b refilled", got, c.refiller.depth())
+	}
+	// A delete drops the queued refill, which would bring the item back.
+	c.GetItem(ctx, "c")
+	if err := c.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if c.refiller.depth() != 0 {
+		t.Errorf("%d refills pending after Delete; want 0", c.refiller.depth())
+	}
+}
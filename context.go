@@ -0,0 +1,38 @@
+package aecache
+
+import "context"
+
+// A contextKey is a key for values stored in a context by this package.
+type contextKey string
+
+// RequestIDKey is the context key of the request ID, see WithRequestID.
+var RequestIDKey interface{} = contextKey("request-id")
+
+// WithRequestID returns a context carrying a request or trace ID.
+// It is included in errors and hooks emitted by the cache, so that cache
+// events can be correlated with the request that caused them.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+// RequestID returns the request ID carried by a context, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey).(string)
+	return id
+}
+
+// refillKey is the context key marking writes which copy items from another
+// layer or a snapshot, see withRefill.
+var refillKey interface{} = contextKey("refill")
+
+// withRefill returns a context marking writes which copy items, so layers
+// keep their Stored time rather than stamp them as new, see stamp.
+func withRefill(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refillKey, true)
+}
+
+// isRefill tells whether a context marks writes which copy items.
+func isRefill(ctx context.Context) bool {
+	refill, _ := ctx.Value(refillKey).(bool)
+	return refill
+}
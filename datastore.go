@@ -1,111 +1,996 @@
 package aecache
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"hash/crc32"
+	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/StalkR/aecache/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// A datastoreCache represents a cache on top of Cloud Datastore.
-type datastoreCache struct {
-	m         sync.Mutex // protects below
+// Datastore limits an entity to 1,048,572 bytes, key and properties included.
+// See https://cloud.google.com/datastore/docs/concepts/limits and, for how
+// sizes are computed, https://cloud.google.com/datastore/docs/concepts/storage-size
+const (
+	datastoreEntityLimit = 1048572
+	// datastoreEntityOverhead is the size of an entity besides its key and
+	// properties, and datastoreKeyOverhead that of a key besides its path.
+	datastoreEntityOverhead = 32
+	datastoreKeyOverhead    = 16
+	// datastoreItemOverhead is the size of a CacheItem of the default kind
+	// besides its key name and value, with a checksum and without Meta nor
+	// tag: key overhead and kind, entity overhead, then each property name
+	// and value. Strings and bytes count one more than their length,
+	// timestamps and integers 8.
+	datastoreItemOverhead = datastoreKeyOverhead + len("CacheItem") + 1 + 1 +
+		datastoreEntityOverhead +
+		len("Value") + 1 + 1 +
+		len("Expires") + 1 + 8 +
+		len("Meta") + 1 + 1 +
+		len("Chunks") + 1 + 8 +
+		len("Stored") + 1 + 8 +
+		len("Checksum") + 1 + crc32.Size + 1
+	// datastoreMaxKeyLen is the maximum size of a key name.
+	datastoreMaxKeyLen = 1500
+)
+
+// MaxDatastoreValueSize is the largest value the datastore layer accepts
+// whatever the key, for items without Meta nor tag in the default kind.
+// The actual size of each entity is checked, so shorter keys allow
+// slightly more.
+const MaxDatastoreValueSize = datastoreEntityLimit - datastoreItemOverhead - datastoreMaxKeyLen
+
+// datastoreKeySize returns the size of a key: the kind and name or ID of
+// each element of its path, plus the key overhead.
+func datastoreKeySize(k *datastore.Key) int {
+	size := datastoreKeyOverhead
+	for ; k != nil; k = k.Parent {
+		size += len(k.Kind) + 1
+		if k.Name != "" {
+			size += len(k.Name) + 1
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
+
+// datastoreEntitySize returns the size of a CacheItem entity: its key, the
+// name and value of each property and the entity overhead.
+func datastoreEntitySize(k *datastore.Key, e *internal.CacheItem) int {
+	size := datastoreKeySize(k) + datastoreEntityOverhead
+	size += len("Value") + 1 + len(e.Value) + 1
+	size += len("Expires") + 1 + 8
+	size += len("Meta") + 1 + len(e.Meta) + 1
+	size += len("Chunks") + 1 + 8
+	if e.Tag != "" {
+		size += len("Tag") + 1 + len(e.Tag) + 1
+	}
+	size += len("Stored") + 1 + 8
+	size += len("Checksum") + 1 + len(e.Checksum) + 1
+	return size
+}
+
+// tooBig tells whether a CacheItem of a key would exceed the entity limit.
+func (a *DatastoreCache) tooBig(key string, e *internal.CacheItem) bool {
+	return datastoreEntitySize(datastore.NameKey(a.kind, key, nil), e) > datastoreEntityLimit
+}
+
+// toCacheItem converts an Item to store in the datastore.
+// Its tag is kept when tags are enabled, and its value is checksummed when
+// checksums are enabled.
+func (a *DatastoreCache) toCacheItem(ctx context.Context, item Item) (*internal.CacheItem, error) {
+	item = stamp(ctx, item, a.clock.Now())
+	e := &internal.CacheItem{
+		Value:   item.Value,
+		Expires: item.Expires,
+		Stored:  item.Stored,
+	}
+	if item.Meta != nil {
+		meta, err := json.Marshal(item.Meta)
+		if err != nil {
+			return nil, err
+		}
+		e.Meta = meta
+	}
+	if a.tags {
+		e.Tag = item.Meta[TagMeta]
+	}
+	if a.checksum {
+		e.Checksum = checksum(item.Value)
+	}
+	return e, nil
+}
+
+// fromCacheItem converts an item stored in the datastore to an Item.
+func fromCacheItem(e *internal.CacheItem) (Item, error) {
+	item := Item{
+		Value:   e.Value,
+		Expires: e.Expires,
+		Stored:  e.Stored,
+	}
+	if len(e.Meta) > 0 {
+		if err := json.Unmarshal(e.Meta, &item.Meta); err != nil {
+			return Item{}, err
+		}
+	}
+	return item, nil
+}
+
+// A DatastoreCache represents a cache on top of Cloud Datastore.
+type DatastoreCache struct {
+	clock     Clock
+	kind      string        // kind of the entities
+	delay     time.Duration // between batches of deletes in Clean
+	maxKeys   int           // deleted by Clean, 0 for no limit
+	tags      bool          // store tags indexed, for DeleteByTag
+	checksum  bool          // store a checksum of values
+	reconnect int           // connection errors before reconnecting, 0 for never
+	logger    *log.Logger   // for reconnects, nil for none
+	opTimeout time.Duration // of operations without a deadline, 0 for none
+	maxKeyLen int           // of keys validated, 0 to not validate
+	sem       chan struct{} // limits concurrent operations, nil for no limit
+	m         sync.Mutex    // protects below, held while connecting
 	connected bool
 	client    *datastore.Client
+	failures  int       // consecutive failed connection attempts
+	retryAt   time.Time // no connection attempt before, after a failure
+	connErr   error     // error of the last failed attempt
+	errors    int       // connection errors of operations since connected
+	gen       uint64    // generation of the client, incremented on each dial
 }
 
-// newDatastoreCache creates a new datastoreCache.
-func newDatastoreCache() *datastoreCache {
-	return &datastoreCache{}
+// NewDatastoreCache creates a new DatastoreCache.
+func NewDatastoreCache(opts ...Option) *DatastoreCache {
+	o := newOptions(opts...)
+	a := &DatastoreCache{
+		clock:     o.clock,
+		kind:      o.kind,
+		delay:     o.cleanDelay,
+		maxKeys:   o.cleanMaxKeys,
+		tags:      o.tags,
+		checksum:  o.checksum,
+		reconnect: o.reconnectAfter,
+		logger:    o.logger,
+		opTimeout: o.opTimeout,
+	}
+	if o.validateKeys {
+		a.maxKeyLen = o.maxKeyLen
+		if a.maxKeyLen <= 0 || a.maxKeyLen > datastoreMaxKeyLen {
+			a.maxKeyLen = datastoreMaxKeyLen
+		}
+	}
+	if o.maxConcurrent > 0 {
+		a.sem = make(chan struct{}, o.maxConcurrent)
+	}
+	return a
 }
 
+// Backoff between failed connection attempts, doubling from min up to max.
+const (
+	connectMinBackoff = 100 * time.Millisecond
+	connectMaxBackoff = 30 * time.Second
+)
+
 // connect connects a client to the datastore.
 // It detects the project ID from credentials.
-func (a *datastoreCache) connect(ctx context.Context) error {
+// Only one attempt is in flight at a time, others wait for it. After a
+// failure, attempts back off exponentially: until the next attempt is due,
+// the last error is returned, so a burst of requests does not hammer the
+// metadata server for credentials.
+// It returns the generation of the client connected.
+func (a *DatastoreCache) connect(ctx context.Context) (uint64, error) {
 	a.m.Lock()
 	defer a.m.Unlock()
 	if a.connected {
-		return nil
+		return a.gen, nil
+	}
+	if a.clock.Now().Before(a.retryAt) {
+		return a.gen, a.connErr
 	}
+	err := a.dial(ctx)
+	return a.gen, err
+}
+
+// dial creates a client, backing off on failure. The caller holds a.m.
+func (a *DatastoreCache) dial(ctx context.Context) error {
 	client, err := datastore.NewClient(ctx, datastore.DetectProjectID)
 	if err != nil {
+		backoff := connectMinBackoff << uint(a.failures)
+		if backoff > connectMaxBackoff || backoff <= 0 {
+			backoff = connectMaxBackoff
+		}
+		a.failures++
+		a.retryAt = a.clock.Now().Add(backoff)
+		a.connErr = err
 		return err
 	}
 	a.client = client
+	a.gen++
 	a.connected = true
+	a.failures = 0
+	a.retryAt = time.Time{}
+	a.connErr = nil
+	a.errors = 0
+	return nil
+}
+
+// Reconnect closes the client, if connected, and connects a new one, e.g.
+// when the connection went bad after a network partition. Operations in
+// flight on the old client may fail. If connecting fails, the layer is left
+// disconnected and operations connect again on demand, with backoff.
+func (a *DatastoreCache) Reconnect(ctx context.Context) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.redial(ctx)
+}
+
+// redial closes the client, if connected, and dials a new one.
+// The caller holds a.m.
+func (a *DatastoreCache) redial(ctx context.Context) error {
+	if a.connected {
+		a.connected = false
+		a.client.Close()
+	}
+	return a.dial(ctx)
+}
+
+// conn returns the client, for operations started with begin.
+func (a *DatastoreCache) conn() *datastore.Client {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.client
+}
+
+// opError returns the error of an operation on the datastore as a
+// CacheError. With WithReconnectAfter, connection errors are counted and
+// the layer reconnects once there are enough. Only errors of operations
+// started on the current client, of generation gen from begin, count: those
+// of operations in flight on a client since replaced do not trigger another
+// reconnect.
+func (a *DatastoreCache) opError(ctx context.Context, gen uint64, op, key string, err error) error {
+	if a.reconnect > 0 && isConnError(ctx, err) {
+		a.m.Lock()
+		current := a.connected && gen == a.gen
+		if current {
+			a.errors++
+		}
+		if current && a.errors >= a.reconnect {
+			logf(a.logger, "aecache: datastore: reconnecting after %d connection errors, last: %v", a.reconnect, err)
+			if err := a.redial(ctx); err != nil {
+				logf(a.logger, "aecache: datastore: reconnecting: %v", err)
+			}
+		}
+		a.m.Unlock()
+	}
+	return newCacheError(ctx, op, key, err)
+}
+
+// isConnError tells whether an error of an operation comes from the
+// connection rather than the operation itself or its context: a gRPC status
+// Unavailable, or Internal or Unknown raised by the transport.
+func isConnError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.Unavailable:
+		return true
+	case codes.Internal, codes.Unknown:
+		return strings.Contains(s.Message(), "transport")
+	}
+	return false
+}
+
+// Connect connects to the datastore if not already connected.
+// Operations connect on demand, so this is only needed to check early.
+func (a *DatastoreCache) Connect(ctx context.Context) error {
+	_, err := a.connect(ctx)
+	return err
+}
+
+// Close closes the client, if connected.
+func (a *DatastoreCache) Close() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.connected {
+		return nil
+	}
+	a.connected = false
+	return a.client.Close()
+}
+
+// timeout returns a context with the operation timeout, unless ctx already
+// has a deadline or the timeout is disabled.
+func (a *DatastoreCache) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || a.opTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, a.opTimeout)
+}
+
+// validate checks a key with WithKeyValidation.
+func (a *DatastoreCache) validate(key string) error {
+	if a.maxKeyLen == 0 {
+		return nil
+	}
+	return ValidateKey(key, a.maxKeyLen)
+}
+
+// validateAll checks keys with validate, returning the first error.
+func (a *DatastoreCache) validateAll(keys []string) error {
+	for _, key := range keys {
+		if err := a.validate(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// begin connects and waits for a slot to run an operation, or for the
+// context to be done. The slot must be released with end. It returns the
+// generation of the client, for opError.
+func (a *DatastoreCache) begin(ctx context.Context) (uint64, error) {
+	gen, err := a.connect(ctx)
+	if err != nil {
+		return gen, err
+	}
+	if a.sem == nil {
+		return gen, nil
+	}
+	select {
+	case a.sem <- struct{}{}:
+		return gen, nil
+	case <-ctx.Done():
+		return gen, ctx.Err()
+	}
+}
+
+// end releases the slot of an operation started with begin.
+func (a *DatastoreCache) end() {
+	if a.sem == nil {
+		return
+	}
+	<-a.sem
+}
+
+// Ping checks the datastore is reachable with a cheap keys-only query.
+func (a *DatastoreCache) Ping(ctx context.Context) error {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "ping", "", err)
+	}
+	defer a.end()
+	q := datastore.NewQuery(a.kind).KeysOnly().Limit(1)
+	if _, err := a.conn().GetAll(ctx, q, nil); err != nil {
+		return a.opError(ctx, gen, "ping", "", err)
+	}
 	return nil
 }
 
+// Name returns the name of the layer.
+func (a *DatastoreCache) Name() string {
+	return "datastore"
+}
+
 // Set sets a key to a value with an expiration.
-func (a *datastoreCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+// Gets by key are strongly consistent, so once Set returns, the value is
+// seen by the gets of every instance; only queries, as used by Clean and
+// DeleteByTag, may lag. Across a CombinedCache, other instances may still
+// read an older item from their faster layers, unless reading with
+// WithConsistency(Authoritative).
+func (a *DatastoreCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
 	if expiration <= 0 {
 		return nil
 	}
-	// Per https://godoc.org/cloud.google.com/go/datastore
-	// - []byte (up to 1 megabyte in length)
-	if len(value) >= 1<<20 {
-		return ErrTooBig
-	}
-	if err := a.connect(ctx); err != nil {
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *DatastoreCache) SetItem(ctx context.Context, key string, item Item) error {
+	if err := a.validate(key); err != nil {
 		return err
 	}
-	k := datastore.NameKey("CacheItem", key, nil)
-	item := internal.CacheItem{
-		Value:   value,
-		Expires: time.Now().Add(expiration),
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
 	}
-	if _, err := a.client.Put(ctx, k, &item); err != nil {
+	e, err := a.toCacheItem(ctx, item)
+	if err != nil {
 		return err
 	}
+	if a.tooBig(key, e) {
+		return ErrTooBig
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "set", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	if _, err := a.conn().Put(ctx, k, e); err != nil {
+		return a.opError(ctx, gen, "set", key, err)
+	}
 	return nil
 }
 
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+// It uses a transaction to check existence before writing.
+func (a *DatastoreCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if err := a.validate(key); err != nil {
+		return false, err
+	}
+	if expiration <= 0 {
+		return false, nil
+	}
+	now := a.clock.Now()
+	e, err := a.toCacheItem(ctx, Item{Value: value, Expires: now.Add(expiration), Stored: now})
+	if err != nil {
+		return false, err
+	}
+	if a.tooBig(key, e) {
+		return false, ErrTooBig
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return false, a.opError(ctx, gen, "add", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	var added bool
+	_, err = a.conn().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		added = false
+		var item internal.CacheItem
+		err := tx.Get(k, &item)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && !item.Expires.Before(a.clock.Now()) {
+			return nil
+		}
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		added = true
+		return nil
+	})
+	if err != nil {
+		return false, a.opError(ctx, gen, "add", key, err)
+	}
+	return added, nil
+}
+
 // Get gets the value and expiration for a key.
-func (a *datastoreCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
-	if err := a.connect(ctx); err != nil {
+func (a *DatastoreCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
 		return nil, time.Time{}, err
 	}
-	k := datastore.NameKey("CacheItem", key, nil)
-	item := internal.CacheItem{}
-	err := a.client.Get(ctx, k, &item)
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// An expired item is deleted.
+func (a *DatastoreCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.get(ctx, key, true)
+}
+
+// Peek gets the item for a key, without deleting it if expired, so only
+// read permission is needed.
+func (a *DatastoreCache) Peek(ctx context.Context, key string) (Item, error) {
+	return a.get(ctx, key, false)
+}
+
+// get gets the item for a key, deleting it if expired or corrupt and del is
+// true.
+func (a *DatastoreCache) get(ctx context.Context, key string, del bool) (Item, error) {
+	if err := a.validate(key); err != nil {
+		return Item{}, err
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return Item{}, a.opError(ctx, gen, "get", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	e := internal.CacheItem{}
+	err = a.conn().Get(ctx, k, &e)
 	if err == datastore.ErrNoSuchEntity {
-		return nil, time.Time{}, ErrCacheMiss
+		return Item{}, ErrCacheMiss
 	}
 	if err != nil {
-		return nil, time.Time{}, err
+		return Item{}, a.opError(ctx, gen, "get", key, err)
 	}
-	if item.Expires.Before(time.Now()) {
-		if err := a.client.Delete(ctx, k); err != nil {
-			return nil, time.Time{}, err
+	if e.Expires.Before(a.clock.Now()) || corrupt(e.Value, e.Checksum) {
+		if !del {
+			return Item{}, ErrCacheMiss
 		}
-		return nil, time.Time{}, ErrCacheMiss
+		if err := a.conn().Delete(ctx, k); err != nil {
+			return Item{}, a.opError(ctx, gen, "get", key, err)
+		}
+		return Item{}, ErrCacheMiss
 	}
-	return item.Value, item.Expires, nil
+	item, err := fromCacheItem(&e)
+	if err != nil {
+		return Item{}, newCacheError(ctx, "get", key, err)
+	}
+	return item, nil
 }
 
-// Clean deletes expired items.
-func (a *datastoreCache) Clean(ctx context.Context) error {
-	if err := a.connect(ctx); err != nil {
-		return err
+// TTLs returns the remaining time to live of keys, omitting those missing or
+// expired. It looks keys up with GetMulti, in batches.
+func (a *DatastoreCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	if err := a.validateAll(keys); err != nil {
+		return nil, err
 	}
-	q := datastore.NewQuery("CacheItem").Filter("Expires <", time.Now()).KeysOnly()
-	keys, err := a.client.GetAll(ctx, q, nil)
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
 	if err != nil {
-		return err
+		return nil, a.opError(ctx, gen, "ttls", "", err)
 	}
-	// Batch deletes, per error "cannot write more than 500 entities in a single call".
-	const batchSize = 500
+	defer a.end()
+	// Batch lookups, per error "cannot get more than 1000 keys in a single call".
+	const batchSize = 1000
+	ttls := make(map[string]time.Duration)
 	for len(keys) > 0 {
 		n := batchSize
 		if n > len(keys) {
 			n = len(keys)
 		}
-		if err := a.client.DeleteMulti(ctx, keys[:n]); err != nil {
+		k := make([]*datastore.Key, n)
+		for i, key := range keys[:n] {
+			k[i] = datastore.NameKey(a.kind, key, nil)
+		}
+		items := make([]internal.CacheItem, n)
+		err := a.conn().GetMulti(ctx, k, items)
+		errs, multi := err.(datastore.MultiError)
+		if err != nil && !multi {
+			return nil, a.opError(ctx, gen, "ttls", "", err)
+		}
+		now := a.clock.Now()
+		for i, key := range keys[:n] {
+			if multi && errs[i] != nil {
+				if errs[i] != datastore.ErrNoSuchEntity {
+					return nil, a.opError(ctx, gen, "ttls", key, errs[i])
+				}
+				continue
+			}
+			if !items[i].Expires.Before(now) {
+				ttls[key] = items[i].Expires.Sub(now)
+			}
+		}
+		keys = keys[n:]
+	}
+	return ttls, nil
+}
+
+// Clean deletes expired items.
+// It can be throttled with WithCleanDelay and bounded with WithCleanMaxKeys.
+func (a *DatastoreCache) Clean(ctx context.Context) error {
+	return a.clean(ctx, a.kind)
+}
+
+// A CleanBudget bounds the work of a Clean run, so its cost is predictable.
+// A zero bound means no bound.
+type CleanBudget struct {
+	MaxReads   int // keys read by the query of expired items
+	MaxDeletes int // expired items deleted
+}
+
+// A CleanResult represents the work done by a Clean run within a budget.
+type CleanResult struct {
+	Reads   int  // keys read
+	Deletes int  // items deleted
+	More    bool // whether expired items may be left, for another run
+}
+
+// CleanBudgeted deletes expired items within a budget, and tells whether
+// expired items may be left, so a scheduler can call it again until done
+// and pace runs by the work reported. It is throttled with WithCleanDelay,
+// and the budget replaces WithCleanMaxKeys.
+func (a *DatastoreCache) CleanBudgeted(ctx context.Context, budget CleanBudget) (CleanResult, error) {
+	return a.cleanBudgeted(ctx, a.kind, budget)
+}
+
+// clean deletes expired entities of a kind, throttled and bounded.
+func (a *DatastoreCache) clean(ctx context.Context, kind string) error {
+	_, err := a.cleanBudgeted(ctx, kind, CleanBudget{MaxDeletes: a.maxKeys})
+	return err
+}
+
+// cleanBudgeted deletes expired entities of a kind, throttled and within a
+// budget. The query is limited to the smallest bound, as reading keys not
+// deleted is wasted.
+// The timeout applies to each call rather than the whole clean, which may
+// wait between batches.
+func (a *DatastoreCache) cleanBudgeted(ctx context.Context, kind string, budget CleanBudget) (CleanResult, error) {
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return CleanResult{}, a.opError(ctx, gen, "clean", "", err)
+	}
+	limit := budget.MaxReads
+	if limit <= 0 || budget.MaxDeletes > 0 && budget.MaxDeletes < limit {
+		limit = budget.MaxDeletes
+	}
+	q := datastore.NewQuery(kind).Filter("Expires <", a.clock.Now()).KeysOnly()
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	qctx, cancel := a.timeout(ctx)
+	keys, err := a.conn().GetAll(qctx, q, nil)
+	cancel()
+	a.end()
+	if err != nil {
+		return CleanResult{}, a.opError(ctx, gen, "clean", "", err)
+	}
+	r := CleanResult{Reads: len(keys), More: limit > 0 && len(keys) == limit}
+	if err := a.cleanKeys(ctx, keys); err != nil {
+		return r, a.opError(ctx, gen, "clean", "", err)
+	}
+	r.Deletes = len(keys)
+	return r, nil
+}
+
+// CleanPrefix deletes expired items whose key starts with prefix, so short
+// lived items can be cleaned often without scanning the whole kind.
+// It runs a projection query on Expires over the key range, billed as a
+// keys-only query, and is throttled and bounded as Clean. With chunks, only
+// manifests are deleted, their chunks are left to Clean.
+func (a *DatastoreCache) CleanPrefix(ctx context.Context, prefix string) error {
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "clean", prefix, err)
+	}
+	q := datastore.NewQuery(a.kind).
+		Filter("__key__ >=", datastore.NameKey(a.kind, prefix, nil)).
+		Filter("__key__ <", datastore.NameKey(a.kind, prefix+"\uffff", nil)).
+		Project("Expires")
+	var items []internal.CacheItem
+	qctx, cancel := a.timeout(ctx)
+	k, err := a.conn().GetAll(qctx, q, &items)
+	cancel()
+	a.end()
+	if err != nil {
+		return a.opError(ctx, gen, "clean", prefix, err)
+	}
+	now := a.clock.Now()
+	var keys []*datastore.Key
+	for i, item := range items {
+		if a.maxKeys > 0 && len(keys) >= a.maxKeys {
+			break
+		}
+		if item.Expires.Before(now) {
+			keys = append(keys, k[i])
+		}
+	}
+	if err := a.cleanKeys(ctx, keys); err != nil {
+		return a.opError(ctx, gen, "clean", prefix, err)
+	}
+	return nil
+}
+
+// Delete deletes a key.
+func (a *DatastoreCache) Delete(ctx context.Context, key string) error {
+	if err := a.validate(key); err != nil {
+		return err
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", key, err)
+	}
+	defer a.end()
+	if err := a.conn().Delete(ctx, datastore.NameKey(a.kind, key, nil)); err != nil {
+		return a.opError(ctx, gen, "delete", key, err)
+	}
+	return nil
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected, in a transaction. It returns whether the key was deleted.
+// Chunked values are never equal, as their chunks are not read.
+func (a *DatastoreCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	if err := a.validate(key); err != nil {
+		return false, err
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return false, a.opError(ctx, gen, "delete", key, err)
+	}
+	defer a.end()
+	k := datastore.NameKey(a.kind, key, nil)
+	var deleted bool
+	_, err = a.conn().RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		deleted = false
+		var item internal.CacheItem
+		err := tx.Get(k, &item)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if item.Chunks > 0 || item.Expires.Before(a.clock.Now()) || !bytes.Equal(item.Value, expected) {
+			return nil
+		}
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	if err != nil {
+		return false, a.opError(ctx, gen, "delete", key, err)
+	}
+	return deleted, nil
+}
+
+// DeleteMulti deletes keys.
+func (a *DatastoreCache) DeleteMulti(ctx context.Context, keys []string) error {
+	if err := a.validateAll(keys); err != nil {
+		return err
+	}
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", "", err)
+	}
+	defer a.end()
+	var k []*datastore.Key
+	for _, key := range keys {
+		k = append(k, datastore.NameKey(a.kind, key, nil))
+	}
+	if err := a.deleteMulti(ctx, k); err != nil {
+		return a.opError(ctx, gen, "delete", "", err)
+	}
+	return nil
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+// It uses a range query on the key name.
+func (a *DatastoreCache) DeletePrefix(ctx context.Context, prefix string) error {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", prefix, err)
+	}
+	defer a.end()
+	keys, err := a.prefixKeys(ctx, prefix)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", prefix, err)
+	}
+	if err := a.deleteMulti(ctx, keys); err != nil {
+		return a.opError(ctx, gen, "delete", prefix, err)
+	}
+	return nil
+}
+
+// FlushExcept deletes all items but those of the keys to keep, e.g. to
+// reset the cache but keep configuration.
+// It runs a keys-only query on the kind then deletes in batches. With chunks,
+// only manifests are deleted, their chunks are left to Clean.
+func (a *DatastoreCache) FlushExcept(ctx context.Context, keep ...string) error {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", "", err)
+	}
+	defer a.end()
+	k, err := a.conn().GetAll(ctx, datastore.NewQuery(a.kind).KeysOnly(), nil)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", "", err)
+	}
+	keys := keySet(keep)
+	var del []*datastore.Key
+	for _, key := range k {
+		if _, ok := keys[key.Name]; !ok {
+			del = append(del, key)
+		}
+	}
+	if err := a.deleteMulti(ctx, del); err != nil {
+		return a.opError(ctx, gen, "delete", "", err)
+	}
+	return nil
+}
+
+// ScanPrefix returns the keys starting with prefix, in sorted order.
+// Expired items are included until deleted by Get or Clean.
+func (a *DatastoreCache) ScanPrefix(ctx context.Context, prefix string) ([]string, error) {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "scan", prefix, err)
+	}
+	defer a.end()
+	k, err := a.prefixKeys(ctx, prefix)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "scan", prefix, err)
+	}
+	keys := make([]string, len(k))
+	for i, key := range k {
+		keys[i] = key.Name
+	}
+	return keys, nil
+}
+
+// prefixKeys returns the keys starting with prefix with a range query on
+// the key name.
+func (a *DatastoreCache) prefixKeys(ctx context.Context, prefix string) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(a.kind).
+		Filter("__key__ >=", datastore.NameKey(a.kind, prefix, nil)).
+		Filter("__key__ <", datastore.NameKey(a.kind, prefix+"\uffff", nil)).
+		KeysOnly()
+	return a.conn().GetAll(ctx, q, nil)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag. Tags are only stored with
+// WithTags, otherwise no item matches.
+// It runs a keys-only query on the tag then deletes in batches.
+func (a *DatastoreCache) DeleteByTag(ctx context.Context, tag string) error {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", tag, err)
+	}
+	defer a.end()
+	q := datastore.NewQuery(a.kind).Filter("Tag =", tag).KeysOnly()
+	keys, err := a.conn().GetAll(ctx, q, nil)
+	if err != nil {
+		return a.opError(ctx, gen, "delete", tag, err)
+	}
+	if err := a.deleteMulti(ctx, keys); err != nil {
+		return a.opError(ctx, gen, "delete", tag, err)
+	}
+	return nil
+}
+
+// Latest returns up to limit items not expired, expiring last first, as a
+// proxy for the items set last, e.g. to warm up a memory layer. Chunked and
+// corrupt items are skipped.
+func (a *DatastoreCache) Latest(ctx context.Context, limit int) (map[string]Item, error) {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "latest", "", err)
+	}
+	defer a.end()
+	q := datastore.NewQuery(a.kind).Filter("Expires >=", a.clock.Now()).Order("-Expires").Limit(limit)
+	var entities []internal.CacheItem
+	keys, err := a.conn().GetAll(ctx, q, &entities)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "latest", "", err)
+	}
+	items := make(map[string]Item, len(keys))
+	for i, k := range keys {
+		e := &entities[i]
+		if e.Chunks > 0 || corrupt(e.Value, e.Checksum) {
+			continue
+		}
+		item, err := fromCacheItem(e)
+		if err != nil {
+			continue
+		}
+		items[k.Name] = item
+	}
+	return items, nil
+}
+
+// SortedKeys returns the keys of the items in sorted order.
+// Expired items are included until deleted by Get or Clean.
+func (a *DatastoreCache) SortedKeys(ctx context.Context) ([]string, error) {
+	return a.KeysPage(ctx, "", 0)
+}
+
+// KeysPage returns the keys of the items in sorted order, after a key and at
+// most limit of them, or all if limit is 0. It runs a keys-only query ordered
+// by key, starting after the given key, so pages cost one query each.
+// Expired items are included until deleted by Get or Clean.
+func (a *DatastoreCache) KeysPage(ctx context.Context, after string, limit int) ([]string, error) {
+	ctx, cancel := a.timeout(ctx)
+	defer cancel()
+	gen, err := a.begin(ctx)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "keys", after, err)
+	}
+	defer a.end()
+	q := datastore.NewQuery(a.kind).Order("__key__").KeysOnly()
+	if after != "" {
+		q = q.Filter("__key__ >", datastore.NameKey(a.kind, after, nil))
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	k, err := a.conn().GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, a.opError(ctx, gen, "keys", after, err)
+	}
+	keys := make([]string, len(k))
+	for i, key := range k {
+		keys[i] = key.Name
+	}
+	return keys, nil
+}
+
+// datastoreBatchSize bounds the keys deleted per call, per error "cannot
+// write more than 500 entities in a single call".
+const datastoreBatchSize = 500
+
+// batchLen returns the number of keys of the next batch.
+func batchLen(keys []*datastore.Key) int {
+	if len(keys) < datastoreBatchSize {
+		return len(keys)
+	}
+	return datastoreBatchSize
+}
+
+// deleteMulti deletes keys in batches, in the slot of the operation.
+func (a *DatastoreCache) deleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := batchLen(keys)
+		bctx, cancel := a.timeout(ctx)
+		err := a.conn().DeleteMulti(bctx, keys[:n])
+		cancel()
+		if err != nil {
 			return err
 		}
 		keys = keys[n:]
 	}
 	return nil
 }
+
+// cleanKeys deletes keys in batches for a clean, waiting the clean delay
+// between batches. Each batch takes its own slot, see begin, so a throttled
+// clean does not hold one while it waits; the caller must not hold one.
+func (a *DatastoreCache) cleanKeys(ctx context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := batchLen(keys)
+		if _, err := a.begin(ctx); err != nil {
+			return err
+		}
+		err := a.deleteMulti(ctx, keys[:n])
+		a.end()
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+		if len(keys) == 0 || a.delay <= 0 {
+			continue
+		}
+		select {
+		case <-time.After(a.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
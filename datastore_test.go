@@ -0,0 +1,226 @@
+package aecache
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/StalkR/aecache/internal"
+)
+
+// connectedDatastore returns a DatastoreCache marked connected, without a
+// client, to test what precedes RPCs.
+func connectedDatastore(opts ...Option) *DatastoreCache {
+	a := NewDatastoreCache(opts...)
+	a.connected = true
+	return a
+}
+
+func TestDatastoreTooBig(t *testing.T) {
+	a := NewDatastoreCache(WithChecksum())
+	ctx := context.Background()
+	key := strings.Repeat("k", datastoreMaxKeyLen)
+	for _, tt := range []struct {
+		size int
+		want bool
+	}{
+		{MaxDatastoreValueSize - 1, false},
+		{MaxDatastoreValueSize, false},
+		{MaxDatastoreValueSize + 1, true},
+	} {
+		e, err := a.toCacheItem(ctx, Item{Value: make([]byte, tt.size), Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.tooBig(key, e); got != tt.want {
+			t.Errorf("tooBig(%v bytes) = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestDatastoreEntitySize(t *testing.T) {
+	e := &internal.CacheItem{
+		Value:    []byte("value"),
+		Meta:     []byte(`{"aecache-tag":"t"}`),
+		Tag:      "t",
+		Checksum: []byte{1, 2, 3, 4},
+	}
+	k := datastore.NameKey("CacheItem", "key", nil)
+	want := 16 + 10 + 4 + // key: overhead, kind, name
+		32 + // entity overhead
+		6 + 6 + // Value
+		8 + 8 + // Expires
+		5 + 20 + // Meta
+		7 + 8 + // Chunks
+		4 + 2 + // Tag
+		7 + 8 + // Stored
+		9 + 5 // Checksum
+	if got := datastoreEntitySize(k, e); got != want {
+		t.Errorf("datastoreEntitySize() = %v, want %v", got, want)
+	}
+	chunk := datastore.NameKey("CacheItemChunk", "12", k)
+	if got, want := datastoreKeySize(chunk), 16+10+4+15+3; got != want {
+		t.Errorf("datastoreKeySize(chunk) = %v, want %v", got, want)
+	}
+}
+
+func TestDatastoreMaxConcurrent(t *testing.T) {
+	const max = 3
+	a := connectedDatastore(WithMaxConcurrent(max))
+	ctx := context.Background()
+	var inFlight, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.begin(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+			defer a.end()
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		}()
+	}
+	wg.Wait()
+	if peak > max {
+		t.Errorf("%v operations in flight, want at most %v", peak, max)
+	}
+}
+
+func TestDatastoreMaxConcurrentContext(t *testing.T) {
+	a := connectedDatastore(WithMaxConcurrent(1))
+	if _, err := a.begin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.end()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.begin(ctx); err != context.DeadlineExceeded {
+		t.Errorf("begin with all slots taken = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func BenchmarkDatastoreMaxConcurrent(b *testing.B) {
+	a := connectedDatastore(WithMaxConcurrent(4))
+	ctx := context.Background()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := a.begin(ctx); err != nil {
+				b.Fatal(err)
+			}
+			a.end()
+		}
+	})
+}
+
+// TestDatastoreKinds checks caches of different kinds do not see each
+// other's keys. It needs the datastore emulator, see
+// https://cloud.google.com/datastore/docs/tools/datastore-emulator
+func TestDatastoreKinds(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	sessions := NewDatastoreCache(WithKind("SessionCache" + suffix))
+	fragments := NewDatastoreCache(WithKind("FragmentCache" + suffix))
+	if err := sessions.Set(ctx, "shared", []byte("session"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Set(ctx, "only", []byte("session"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := fragments.Set(ctx, "shared", []byte("fragment"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fragments.GetItem(ctx, "only"); err != ErrCacheMiss {
+		t.Errorf("GetItem(only) in the other kind: got err %v, want ErrCacheMiss", err)
+	}
+	for _, tt := range []struct {
+		c    *DatastoreCache
+		want string
+	}{
+		{sessions, "session"},
+		{fragments, "fragment"},
+	} {
+		item, err := tt.c.GetItem(ctx, "shared")
+		if err != nil || string(item.Value) != tt.want {
+			t.Errorf("GetItem(shared) in %v = %q, %v; want %q", tt.c.kind, item.Value, err, tt.want)
+		}
+	}
+	if err := sessions.DeleteMulti(ctx, []string{"shared", "only"}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := fragments.GetItem(ctx, "shared"); err != nil || string(item.Value) != "fragment" {
+		t.Errorf("GetItem(shared) after a delete in the other kind = %q, %v; want fragment", item.Value, err)
+	}
+	fragments.Delete(ctx, "shared")
+}
+
+// TestDatastoreAddChecksum checks Add stores items as Set does, with their
+// checksum. It needs the datastore emulator.
+func TestDatastoreAddChecksum(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	a := NewDatastoreCache(WithChecksum(), WithKind("AddCache"+strconv.FormatInt(time.Now().UnixNano(), 36)))
+	if added, err := a.Add(ctx, "k", []byte("v"), time.Hour); err != nil || !added {
+		t.Fatalf("Add() = %v, %v; want added", added, err)
+	}
+	defer a.Delete(ctx, "k")
+	var e internal.CacheItem
+	if err := a.conn().Get(ctx, datastore.NameKey(a.kind, "k", nil), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Checksum == nil || corrupt(e.Value, e.Checksum) {
+		t.Errorf("Checksum = %x, want checksum of %q", e.Checksum, e.Value)
+	}
+	if e.Stored.IsZero() {
+		t.Errorf("Stored not set")
+	}
+}
+
+// TestDatastoreKeyValidation checks every operation on keys rejects invalid
+// ones with WithKeyValidation before reaching the datastore: the cache has
+// no client, so any call reaching it would fail otherwise.
+func TestDatastoreKeyValidation(t *testing.T) {
+	ctx := context.Background()
+	a := connectedDatastore(WithKeyValidation(0))
+	const bad = "__reserved"
+	item := Item{Value: []byte("v"), Expires: time.Now().Add(time.Hour)}
+	for _, tt := range []struct {
+		op  string
+		err error
+	}{
+		{"Set", a.Set(ctx, bad, []byte("v"), time.Hour)},
+		{"SetItem", a.SetItem(ctx, bad, item)},
+		{"Add", func() error { _, err := a.Add(ctx, bad, []byte("v"), time.Hour); return err }()},
+		{"Get", func() error { _, _, err := a.Get(ctx, bad); return err }()},
+		{"GetItem", func() error { _, err := a.GetItem(ctx, bad); return err }()},
+		{"Peek", func() error { _, err := a.Peek(ctx, bad); return err }()},
+		{"TTLs", func() error { _, err := a.TTLs(ctx, []string{"ok", bad}); return err }()},
+		{"Delete", a.Delete(ctx, bad)},
+		{"DeleteIf", func() error { _, err := a.DeleteIf(ctx, bad, []byte("v")); return err }()},
+		{"DeleteMulti", a.DeleteMulti(ctx, []string{"ok", bad})},
+	} {
+		if tt.err != ErrInvalidKey {
+			t.Errorf("%v(%q) = %v, want ErrInvalidKey", tt.op, bad, tt.err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package aecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobPrefix prefixes the keys of the values stored by content hash in a
+// deduplicated cache.
+const blobPrefix = "aecache-blob:"
+
+// A dedupCache represents a cache where identical values are stored once,
+// under their content hash, and keys point to them.
+type dedupCache struct {
+	cache Cache
+	clock Clock
+	m     sync.Mutex            // protects below, not held across calls to cache
+	keys  map[string]dedupRef   // key to the blob it points to
+	blobs map[string]*dedupBlob // hash to its references
+}
+
+// A dedupRef represents a key pointing to a blob.
+type dedupRef struct {
+	hash    string
+	expires time.Time
+	tag     string
+}
+
+// A dedupBlob represents a value stored by content hash.
+type dedupBlob struct {
+	users   int        // goroutines using it, protected by dedupCache.m
+	m       sync.Mutex // serializes writes and deletes of the value, protects below
+	refs    int
+	expires time.Time // latest expiration of the keys pointing to it
+}
+
+// Deduped wraps a cache so that a value set under several keys is stored
+// once, under its hex SHA-256 prefixed by "aecache-blob:", and each key holds
+// the hash with the expiration and Meta of its item. A value is kept until
+// the last key pointing to it expires, and deleted once no key points to it.
+// Gets cost two reads of the underlying cache, and a key whose value is
+// missing, e.g. evicted, is a miss, as may be a key set concurrently.
+// It supports the WithClock option.
+//
+// References are counted in the process, so the underlying cache must be
+// local to it, like MemoryCache: with a cache shared by several processes,
+// like DatastoreCache, a value no longer referenced in a process would be
+// deleted for all.
+func Deduped(cache Cache, opts ...Option) Cache {
+	o := newOptions(opts...)
+	return &dedupCache{
+		cache: cache,
+		clock: o.clock,
+		keys:  make(map[string]dedupRef),
+		blobs: make(map[string]*dedupBlob),
+	}
+}
+
+// Set sets a key to a value with an expiration.
+func (a *dedupCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+// The value is stored only if no other key points to it, or to extend its
+// expiration.
+func (a *dedupCache) SetItem(ctx context.Context, key string, item Item) error {
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	h, err := a.store(ctx, item)
+	if err != nil {
+		return err
+	}
+	if err := a.cache.SetItem(ctx, key, pointer(item, h)); err != nil {
+		if uerr := a.unstore(ctx, h); uerr != nil {
+			return uerr
+		}
+		return err
+	}
+	return a.replace(ctx, key, dedupRef{hash: h, expires: item.Expires, tag: item.Meta[TagMeta]})
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *dedupCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		return false, nil
+	}
+	item := Item{Value: value, Expires: a.clock.Now().Add(expiration)}
+	h, err := a.store(ctx, item)
+	if err != nil {
+		return false, err
+	}
+	added, err := a.cache.Add(ctx, key, []byte(h), expiration)
+	if err != nil || !added {
+		if uerr := a.unstore(ctx, h); uerr != nil {
+			return false, uerr
+		}
+		return false, err
+	}
+	return true, a.replace(ctx, key, dedupRef{hash: h, expires: item.Expires})
+}
+
+// Get gets the value and expiration for a key.
+func (a *dedupCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// A key whose value is missing is a miss, and left to expire.
+func (a *dedupCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, err := a.cache.GetItem(ctx, key)
+	if err != nil {
+		return Item{}, err
+	}
+	blob, err := a.cache.GetItem(ctx, blobPrefix+string(item.Value))
+	if err != nil {
+		return Item{}, err
+	}
+	item.Value = blob.Value
+	return item, nil
+}
+
+// Peek gets the item for a key, without modifying the underlying cache if it
+// is a Peeker.
+func (a *dedupCache) Peek(ctx context.Context, key string) (Item, error) {
+	item, err := peek(ctx, a.cache, key)
+	if err != nil {
+		return Item{}, err
+	}
+	blob, err := peek(ctx, a.cache, blobPrefix+string(item.Value))
+	if err != nil {
+		return Item{}, err
+	}
+	item.Value = blob.Value
+	return item, nil
+}
+
+// Clean deletes expired items, and values no key points to anymore.
+func (a *dedupCache) Clean(ctx context.Context) error {
+	now := a.clock.Now()
+	if err := a.release(ctx, func(key string, ref dedupRef) bool {
+		return ref.expires.Before(now)
+	}); err != nil {
+		return err
+	}
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (a *dedupCache) Delete(ctx context.Context, key string) error {
+	return a.DeleteMulti(ctx, []string{key})
+}
+
+// DeleteMulti deletes keys, and values no key points to anymore.
+func (a *dedupCache) DeleteMulti(ctx context.Context, keys []string) error {
+	set := keySet(keys)
+	if err := a.release(ctx, func(key string, ref dedupRef) bool {
+		_, ok := set[key]
+		return ok
+	}); err != nil {
+		return err
+	}
+	return a.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix, and values no key
+// points to anymore. A prefix of "aecache-blob:", like "a", also deletes the
+// values of other keys, which become misses.
+func (a *dedupCache) DeletePrefix(ctx context.Context, prefix string) error {
+	if err := a.release(ctx, func(key string, ref dedupRef) bool {
+		return strings.HasPrefix(key, prefix)
+	}); err != nil {
+		return err
+	}
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag, and values no key points
+// to anymore.
+func (a *dedupCache) DeleteByTag(ctx context.Context, tag string) error {
+	if err := a.release(ctx, func(key string, ref dedupRef) bool {
+		return ref.tag == tag
+	}); err != nil {
+		return err
+	}
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *dedupCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
+
+// store stores the value of an item by content hash, unless already stored
+// expiring later, and returns its hash.
+func (a *dedupCache) store(ctx context.Context, item Item) (string, error) {
+	sum := sha256.Sum256(item.Value)
+	h := hex.EncodeToString(sum[:])
+	b := a.acquire(h)
+	defer a.unacquire(h, b)
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.refs == 0 || item.Expires.After(b.expires) {
+		if err := a.cache.SetItem(ctx, blobPrefix+h, Item{Value: item.Value, Expires: item.Expires}); err != nil {
+			return "", err
+		}
+		b.expires = item.Expires
+	}
+	b.refs++
+	return h, nil
+}
+
+// unstore drops a reference to a value, deleting it at the last one.
+func (a *dedupCache) unstore(ctx context.Context, h string) error {
+	b := a.acquire(h)
+	defer a.unacquire(h, b)
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.refs == 0 {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	b.expires = time.Time{}
+	return a.cache.Delete(ctx, blobPrefix+h)
+}
+
+// acquire returns the blob of a hash, created if needed, and keeps it until
+// unacquire.
+func (a *dedupCache) acquire(h string) *dedupBlob {
+	a.m.Lock()
+	defer a.m.Unlock()
+	b, ok := a.blobs[h]
+	if !ok {
+		b = &dedupBlob{}
+		a.blobs[h] = b
+	}
+	b.users++
+	return b
+}
+
+// unacquire releases a blob from acquire, forgetting it when unused and no
+// key points to it. The blob lock must not be held.
+func (a *dedupCache) unacquire(h string, b *dedupBlob) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	b.users--
+	if b.users == 0 && b.refs == 0 {
+		delete(a.blobs, h)
+	}
+}
+
+// replace points a key to a new reference, dropping its previous one.
+func (a *dedupCache) replace(ctx context.Context, key string, ref dedupRef) error {
+	a.m.Lock()
+	old, ok := a.keys[key]
+	a.keys[key] = ref
+	a.m.Unlock()
+	if !ok {
+		return nil
+	}
+	return a.unstore(ctx, old.hash)
+}
+
+// release forgets the keys matching f and drops their references.
+// It attempts all of them and combines their errors.
+func (a *dedupCache) release(ctx context.Context, f func(key string, ref dedupRef) bool) error {
+	var hashes []string
+	a.m.Lock()
+	for key, ref := range a.keys {
+		if f(key, ref) {
+			delete(a.keys, key)
+			hashes = append(hashes, ref.hash)
+		}
+	}
+	a.m.Unlock()
+	var errs []error
+	for _, h := range hashes {
+		if err := a.unstore(ctx, h); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// pointer returns the item stored under a key pointing to a value by hash.
+func pointer(item Item, h string) Item {
+	item.Value = []byte(h)
+	return item
+}
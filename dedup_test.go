@@ -0,0 +1,60 @@
+package aecache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDedupedStoresOnce(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	m := NewMemoryCache(WithClock(clock))
+	c := Deduped(m, WithClock(clock))
+	c.Set(ctx, "a", []byte("value"), time.Hour)
+	c.Set(ctx, "b", []byte("value"), time.Hour)
+	if m.Len() != 3 {
+		t.Errorf("underlying cache has %d items; want 2 keys and 1 value", m.Len())
+	}
+	c.Delete(ctx, "a")
+	if value, _, err := c.Get(ctx, "b"); err != nil || string(value) != "value" {
+		t.Errorf("Get(b) after Delete(a) = %q, %v; want value", value, err)
+	}
+	c.Delete(ctx, "b")
+	if m.Len() != 0 {
+		t.Errorf("underlying cache has %d items after deleting all keys; want 0", m.Len())
+	}
+}
+
+func TestDedupedExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	m := NewMemoryCache(WithClock(clock))
+	c := Deduped(m, WithClock(clock))
+	c.Set(ctx, "a", []byte("value"), time.Hour)
+	c.Set(ctx, "b", []byte("value"), 2*time.Hour)
+	clock.advance(90 * time.Minute)
+	if _, _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("Get(a) after expiry = %v; want ErrCacheMiss", err)
+	}
+	// The value is kept until the last key pointing to it expires.
+	if value, _, err := c.Get(ctx, "b"); err != nil || string(value) != "value" {
+		t.Errorf("Get(b) = %q, %v; want value", value, err)
+	}
+	if err := c.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("underlying cache has %d items after Clean; want b and its value", m.Len())
+	}
+	clock.advance(time.Hour)
+	if _, _, err := c.Get(ctx, "b"); err != ErrCacheMiss {
+		t.Errorf("Get(b) after expiry = %v; want ErrCacheMiss", err)
+	}
+	if err := c.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 0 {
+		t.Errorf("underlying cache has %d items after Clean; want 0", m.Len())
+	}
+}
@@ -0,0 +1,35 @@
+package aecache
+
+import (
+	"context"
+	"strconv"
+)
+
+// A CacheError represents an error from a cache backend.
+type CacheError struct {
+	Op        string // operation, e.g. "get"
+	Key       string // key or prefix, if any
+	RequestID string // request ID of the context, if any
+	Err       error
+}
+
+// newCacheError wraps a backend error with the operation, key and request ID.
+func newCacheError(ctx context.Context, op, key string, err error) error {
+	return &CacheError{Op: op, Key: key, RequestID: RequestID(ctx), Err: err}
+}
+
+func (e *CacheError) Error() string {
+	s := "cache: " + e.Op
+	if e.Key != "" {
+		s += " " + strconv.Quote(e.Key)
+	}
+	if e.RequestID != "" {
+		s += " (request " + e.RequestID + ")"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the backend error.
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,38 @@
+package aecache
+
+import "context"
+
+// An EvictReason tells why an item was removed from a cache.
+type EvictReason int
+
+// Reasons for which an item is removed from a cache.
+const (
+	// EvictExpired is when an item expired.
+	EvictExpired EvictReason = iota
+	// EvictCapacity is when an item is evicted to make room for others.
+	EvictCapacity
+	// EvictDeleted is when an item is deleted explicitly.
+	EvictDeleted
+)
+
+// String returns a readable name for the reason.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictExpired:
+		return "expired"
+	case EvictCapacity:
+		return "capacity"
+	case EvictDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// An eviction represents an item removed from a cache, pending notification.
+type eviction struct {
+	ctx    context.Context
+	key    string
+	item   Item
+	reason EvictReason
+	hits   uint64 // gets of the item while cached
+}
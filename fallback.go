@@ -0,0 +1,160 @@
+package aecache
+
+import (
+	"context"
+	"time"
+)
+
+// A connecter represents a cache layer that can connect to its backend.
+type connecter interface {
+	Connect(ctx context.Context) error
+}
+
+// A FallbackCache represents a cache layer that is disabled if it could not
+// connect: then all operations are misses or no-ops.
+type FallbackCache struct {
+	cache  Cache
+	active bool
+}
+
+// TryLayer attempts once to connect a cache layer, if it supports it, like
+// DatastoreCache. On failure, it logs a warning, see WithLogger, and disables
+// the layer so a CombinedCache keeps working with its remaining layers, e.g.
+// locally without credentials.
+func TryLayer(ctx context.Context, cache Cache, opts ...Option) *FallbackCache {
+	o := newOptions(opts...)
+	a := &FallbackCache{cache: cache, active: true}
+	if c, ok := cache.(connecter); ok {
+		if err := c.Connect(ctx); err != nil {
+			logf(o.logger, "aecache: disabling cache layer %s: %v", LayerName(cache), err)
+			a.active = false
+		}
+	}
+	return a
+}
+
+// Active tells whether the layer is active, i.e. it connected.
+func (a *FallbackCache) Active() bool {
+	return a.active
+}
+
+// Set sets a key to a value with an expiration.
+func (a *FallbackCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *FallbackCache) SetItem(ctx context.Context, key string, item Item) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.SetItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *FallbackCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if !a.active {
+		return false, nil
+	}
+	return a.cache.Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *FallbackCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	if !a.active {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	return a.cache.Get(ctx, key)
+}
+
+// GetItem gets the item for a key.
+func (a *FallbackCache) GetItem(ctx context.Context, key string) (Item, error) {
+	if !a.active {
+		return Item{}, ErrCacheMiss
+	}
+	return a.cache.GetItem(ctx, key)
+}
+
+// Peek gets the item for a key, without modifying the underlying cache if it
+// is a Peeker.
+func (a *FallbackCache) Peek(ctx context.Context, key string) (Item, error) {
+	if !a.active {
+		return Item{}, ErrCacheMiss
+	}
+	return peek(ctx, a.cache, key)
+}
+
+// Clean deletes expired items.
+func (a *FallbackCache) Clean(ctx context.Context) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (a *FallbackCache) Delete(ctx context.Context, key string) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.Delete(ctx, key)
+}
+
+// Invalidate removes a key and anything the underlying cache remembers
+// about it if it is an Invalidator.
+func (a *FallbackCache) Invalidate(ctx context.Context, key string) error {
+	if !a.active {
+		return nil
+	}
+	return invalidate(ctx, a.cache, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *FallbackCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	if !a.active {
+		return false, nil
+	}
+	return deleteIf(ctx, a.cache, key, expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *FallbackCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+func (a *FallbackCache) DeleteMulti(ctx context.Context, keys []string) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *FallbackCache) DeletePrefix(ctx context.Context, prefix string) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func (a *FallbackCache) DeleteByTag(ctx context.Context, tag string) error {
+	if !a.active {
+		return nil
+	}
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger and active.
+func (a *FallbackCache) Ping(ctx context.Context) error {
+	if !a.active {
+		return nil
+	}
+	return ping(ctx, a.cache)
+}
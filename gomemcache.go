@@ -0,0 +1,393 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memcacheMaxRelative is the longest expiration memcached takes as relative,
+// longer ones must be a Unix time.
+const memcacheMaxRelative = 30 * 24 * time.Hour
+
+// memcacheMaxKeyLen is the longest key memcached accepts.
+const memcacheMaxKeyLen = 250
+
+// memcacheChecksumFlag is set in the flags of items whose encoding is
+// prefixed with its checksum.
+const memcacheChecksumFlag = 1
+
+// A GomemcacheCache represents a cache on top of a memcached cluster, for
+// deployments off App Engine. Items are stored encoded with EncodeItem, or
+// with the codec set by WithItemCodec.
+// Memcached keys are at most 250 bytes without spaces or control characters,
+// other keys are replaced with their hex SHA-256, as HashKeys(c, 250) does,
+// or rejected with WithKeyValidation. Memcached cannot list keys so
+// DeletePrefix and DeleteByTag return ErrNotSupported, and Clean does nothing
+// as memcached expires items itself.
+type GomemcacheCache struct {
+	clock     Clock
+	client    *memcache.Client
+	checksum  bool  // prefix encoded items with their checksum
+	codec     Codec // encodes items, nil for EncodeItem
+	maxKeyLen int   // of keys validated, 0 to hash invalid keys
+}
+
+// NewGomemcacheCache creates a new GomemcacheCache on memcached servers,
+// host:port, chosen by key.
+// It supports the options of NewGomemcacheCacheFromClient.
+func NewGomemcacheCache(servers []string, opts ...Option) *GomemcacheCache {
+	return NewGomemcacheCacheFromClient(memcache.New(servers...), opts...)
+}
+
+// NewGomemcacheCacheFromClient creates a new GomemcacheCache with a client,
+// e.g. with its timeout set.
+// It supports the WithClock, WithChecksum, WithItemCodec and
+// WithKeyValidation options.
+func NewGomemcacheCacheFromClient(client *memcache.Client, opts ...Option) *GomemcacheCache {
+	o := newOptions(opts...)
+	a := &GomemcacheCache{
+		clock:    o.clock,
+		client:   client,
+		checksum: o.checksum,
+		codec:    o.itemCodec,
+	}
+	if o.validateKeys {
+		a.maxKeyLen = o.maxKeyLen
+		if a.maxKeyLen <= 0 || a.maxKeyLen > memcacheMaxKeyLen {
+			a.maxKeyLen = memcacheMaxKeyLen
+		}
+	}
+	return a
+}
+
+// key returns the memcached key of a key: as is if valid, otherwise its hash
+// or, with WithKeyValidation, ErrInvalidKey.
+func (a *GomemcacheCache) key(key string) (string, error) {
+	if a.maxKeyLen == 0 {
+		return hashKey(key, memcacheMaxKeyLen), nil
+	}
+	if err := ValidateKey(key, a.maxKeyLen); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// encode encodes an item with the codec.
+func (a *GomemcacheCache) encode(item Item) ([]byte, error) {
+	if a.codec == nil {
+		return EncodeItem(item)
+	}
+	return a.codec.Marshal(item)
+}
+
+// decode decodes an item with the codec.
+func (a *GomemcacheCache) decode(b []byte) (Item, error) {
+	if a.codec == nil {
+		return DecodeItem(b)
+	}
+	var item Item
+	if err := a.codec.Unmarshal(b, &item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// Ping checks all servers are reachable.
+func (a *GomemcacheCache) Ping(ctx context.Context) error {
+	return a.client.Ping()
+}
+
+// Name returns the name of the layer.
+func (a *GomemcacheCache) Name() string {
+	return "memcache"
+}
+
+// Set sets a key to a value with an expiration.
+func (a *GomemcacheCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *GomemcacheCache) SetItem(ctx context.Context, key string, item Item) error {
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	e, err := a.toMemcache(ctx, key, item)
+	if err != nil {
+		return err
+	}
+	return a.client.Set(e)
+}
+
+// SetItemMulti sets keys to items, skipping those already expired, one at a
+// time as memcached has no batched set.
+func (a *GomemcacheCache) SetItemMulti(ctx context.Context, items map[string]Item) error {
+	for key, item := range items {
+		if err := a.SetItem(ctx, key, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *GomemcacheCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		return false, nil
+	}
+	e, err := a.toMemcache(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+	if err != nil {
+		return false, err
+	}
+	err = a.client.Add(e)
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// toMemcache converts an item to store in memcached. Its expiration is
+// rounded up to the second, at least one as 0 means never in memcached,
+// GetItem checks the exact one.
+func (a *GomemcacheCache) toMemcache(ctx context.Context, key string, item Item) (*memcache.Item, error) {
+	b, err := a.encode(stamp(ctx, item, a.clock.Now()))
+	if err != nil {
+		return nil, err
+	}
+	d := item.Expires.Sub(a.clock.Now())
+	expiration := int32((d + time.Second - 1) / time.Second)
+	if expiration < 1 {
+		expiration = 1
+	}
+	if d > memcacheMaxRelative {
+		expiration = int32(item.Expires.Unix() + 1)
+	}
+	k, err := a.key(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &memcache.Item{Key: k, Value: b, Expiration: expiration}
+	if a.checksum {
+		e.Value = append(checksum(b), b...)
+		e.Flags = memcacheChecksumFlag
+	}
+	return e, nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *GomemcacheCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// A corrupt item is deleted.
+func (a *GomemcacheCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.get(ctx, key, true)
+}
+
+// GetItemMulti gets the items for keys, in one round trip per server,
+// omitting those missing or expired. Corrupt items are deleted.
+func (a *GomemcacheCache) GetItemMulti(ctx context.Context, keys []string) (map[string]Item, error) {
+	names := make(map[string]string, len(keys)) // memcached key to key
+	k := make([]string, 0, len(keys))
+	for _, key := range keys {
+		mk, err := a.key(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := names[mk]; !ok {
+			k = append(k, mk)
+		}
+		names[mk] = key
+	}
+	found, err := a.client.GetMulti(k)
+	if err != nil {
+		return nil, err
+	}
+	now := a.clock.Now()
+	items := make(map[string]Item, len(found))
+	var corrupt []string
+	for mk, e := range found {
+		item, ok, err := a.fromMemcache(e)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			corrupt = append(corrupt, names[mk])
+			continue
+		}
+		if !item.Expires.Before(now) {
+			items[names[mk]] = item
+		}
+	}
+	if err := a.DeleteMulti(ctx, corrupt); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Peek gets the item for a key, without deleting it if corrupt.
+func (a *GomemcacheCache) Peek(ctx context.Context, key string) (Item, error) {
+	return a.get(ctx, key, false)
+}
+
+// get gets the item for a key, deleting it if corrupt and del is true.
+func (a *GomemcacheCache) get(ctx context.Context, key string, del bool) (Item, error) {
+	k, err := a.key(key)
+	if err != nil {
+		return Item{}, err
+	}
+	e, err := a.client.Get(k)
+	if err == memcache.ErrCacheMiss {
+		return Item{}, ErrCacheMiss
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	item, ok, err := a.fromMemcache(e)
+	if err != nil {
+		return Item{}, err
+	}
+	if !ok {
+		if !del {
+			return Item{}, ErrCacheMiss
+		}
+		if err := a.Delete(ctx, key); err != nil {
+			return Item{}, err
+		}
+		return Item{}, ErrCacheMiss
+	}
+	if item.Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// fromMemcache converts an item stored in memcached to an Item, with ok
+// false if it is corrupt.
+func (a *GomemcacheCache) fromMemcache(e *memcache.Item) (item Item, ok bool, err error) {
+	b := e.Value
+	if e.Flags&memcacheChecksumFlag != 0 {
+		if len(b) < 4 || corrupt(b[4:], b[:4]) {
+			return Item{}, false, nil
+		}
+		b = b[4:]
+	}
+	item, err = a.decode(b)
+	if err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+// Clean does nothing, memcached expires items itself.
+func (a *GomemcacheCache) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Delete deletes a key.
+func (a *GomemcacheCache) Delete(ctx context.Context, key string) error {
+	k, err := a.key(key)
+	if err != nil {
+		return err
+	}
+	if err := a.client.Delete(k); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+// Memcached cannot delete conditionally, so the item is instead replaced
+// with compare-and-swap by one expiring immediately.
+func (a *GomemcacheCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	k, err := a.key(key)
+	if err != nil {
+		return false, err
+	}
+	e, err := a.client.Get(k)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	item, ok, err := a.fromMemcache(e)
+	if err != nil || !ok {
+		return false, err
+	}
+	if item.Expires.Before(a.clock.Now()) || !bytes.Equal(item.Value, expected) {
+		return false, nil
+	}
+	e.Expiration = -1
+	err = a.client.CompareAndSwap(e)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteMulti deletes keys.
+func (a *GomemcacheCache) DeleteMulti(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := a.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushExcept flushes all items of all servers, so of every user of the
+// cluster, then sets back the items of the keys to keep. Flushing is not
+// atomic: until they are set back, kept keys are misses, and items set
+// meanwhile are lost too.
+func (a *GomemcacheCache) FlushExcept(ctx context.Context, keep ...string) error {
+	items := make(map[string]Item)
+	for _, key := range keep {
+		item, err := a.Peek(ctx, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		items[key] = item
+	}
+	if err := a.client.FlushAll(); err != nil {
+		return err
+	}
+	for key, item := range items {
+		if err := a.SetItem(ctx, key, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix returns ErrNotSupported, memcached cannot list keys.
+func (a *GomemcacheCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return ErrNotSupported
+}
+
+// DeleteByTag returns ErrNotSupported, memcached cannot list keys.
+func (a *GomemcacheCache) DeleteByTag(ctx context.Context, tag string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,57 @@
+package aecache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGomemcacheExpiration(t *testing.T) {
+	clock := newFakeClock()
+	a := NewGomemcacheCache([]string{"localhost:11211"}, WithClock(clock))
+	for _, tt := range []struct {
+		name    string
+		expires time.Time
+		want    int32
+	}{
+		{"seconds", clock.Now().Add(time.Minute), 60},
+		{"rounded up", clock.Now().Add(1500 * time.Millisecond), 2},
+		{"sub-second", clock.Now().Add(time.Millisecond), 1},
+		{"now", clock.Now(), 1},
+		{"expired", clock.Now().Add(-time.Hour), 1},
+		{"zero", time.Time{}, 1},
+		{"max relative", clock.Now().Add(memcacheMaxRelative), int32(memcacheMaxRelative / time.Second)},
+		{"absolute", clock.Now().Add(memcacheMaxRelative + time.Second), int32(clock.Now().Add(memcacheMaxRelative+time.Second).Unix() + 1)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := a.toMemcache(context.Background(), "k", Item{Value: []byte("v"), Expires: tt.expires})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Expiration != tt.want {
+				t.Errorf("Expiration = %d; want %d", e.Expiration, tt.want)
+			}
+		})
+	}
+}
+
+func TestGomemcacheKeys(t *testing.T) {
+	a := NewGomemcacheCache([]string{"localhost:11211"})
+	long := strings.Repeat("k", memcacheMaxKeyLen+1)
+	for _, key := range []string{"key", "with space", "ctrl\x01", long} {
+		k, err := a.key(key)
+		if err != nil {
+			t.Fatalf("key(%q): %v", key, err)
+		}
+		if len(k) > memcacheMaxKeyLen || strings.ContainsAny(k, " \x01") {
+			t.Errorf("key(%q) = %q; not a valid memcached key", key, k)
+		}
+		if key == "key" && k != key {
+			t.Errorf("key(%q) = %q; want unchanged", key, k)
+		}
+	}
+	if _, err := NewGomemcacheCache(nil, WithKeyValidation(memcacheMaxKeyLen)).key(long); err == nil {
+		t.Errorf("key(long) with WithKeyValidation: no error")
+	}
+}
@@ -0,0 +1,150 @@
+package aecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// A hashedCache represents a cache where invalid keys are replaced with
+// their SHA-256.
+type hashedCache struct {
+	cache  Cache
+	maxLen int
+}
+
+// HashKeys wraps a cache so that keys longer than maxLen bytes or containing
+// disallowed bytes (control characters, spaces, or a leading "__" reserved by
+// the datastore) are replaced with the hex SHA-256 of the key.
+// The transformation is deterministic so it is transparent to Set and Get.
+// Distinct keys collide only if their SHA-256 do, or if a valid key is itself
+// the 64 hex characters hash of another key.
+// DeletePrefix only matches keys that were not hashed.
+func HashKeys(cache Cache, maxLen int) Cache {
+	return &hashedCache{cache: cache, maxLen: maxLen}
+}
+
+// Set sets a key to a value with an expiration.
+func (a *hashedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return a.cache.Set(ctx, a.hash(key), value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *hashedCache) SetItem(ctx context.Context, key string, item Item) error {
+	return a.cache.SetItem(ctx, a.hash(key), item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *hashedCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return a.cache.Add(ctx, a.hash(key), value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *hashedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return a.cache.Get(ctx, a.hash(key))
+}
+
+// GetItem gets the item for a key.
+func (a *hashedCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.cache.GetItem(ctx, a.hash(key))
+}
+
+// Peek gets the item for a key, without modifying the underlying cache if it
+// is a Peeker.
+func (a *hashedCache) Peek(ctx context.Context, key string) (Item, error) {
+	return peek(ctx, a.cache, a.hash(key))
+}
+
+// Delete deletes a key.
+func (a *hashedCache) Delete(ctx context.Context, key string) error {
+	return a.cache.Delete(ctx, a.hash(key))
+}
+
+// Invalidate removes a key and anything the underlying cache remembers
+// about it if it is an Invalidator.
+func (a *hashedCache) Invalidate(ctx context.Context, key string) error {
+	return invalidate(ctx, a.cache, a.hash(key))
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *hashedCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	return deleteIf(ctx, a.cache, a.hash(key), expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *hashedCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+func (a *hashedCache) DeleteMulti(ctx context.Context, keys []string) error {
+	hashed := make([]string, len(keys))
+	for i, key := range keys {
+		hashed[i] = a.hash(key)
+	}
+	return a.cache.DeleteMulti(ctx, hashed)
+}
+
+// Clean deletes expired items.
+func (a *hashedCache) Clean(ctx context.Context) error {
+	return a.cache.Clean(ctx)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+// It only matches keys that were not hashed.
+func (a *hashedCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func (a *hashedCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// hash returns the key to use in the underlying cache.
+func (a *hashedCache) hash(key string) string {
+	return hashKey(key, a.maxLen)
+}
+
+// hashKey returns a key as is if valid and at most maxLen bytes, otherwise
+// its hex SHA-256.
+func hashKey(key string, maxLen int) string {
+	if len(key) <= maxLen && validKey(key) {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateKey returns ErrInvalidKey if a key is empty, longer than maxLen
+// bytes, unless maxLen is 0, or not valid as is for every backend: it
+// contains control characters or spaces, or starts with "__" which the
+// datastore reserves.
+func ValidateKey(key string, maxLen int) error {
+	if key == "" || maxLen > 0 && len(key) > maxLen || !validKey(key) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// validKey tells whether a key can be passed as is to any backend.
+func validKey(key string) bool {
+	if strings.HasPrefix(key, "__") {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *hashedCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
@@ -0,0 +1,58 @@
+package aecache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashKey(t *testing.T) {
+	long := strings.Repeat("k", 11)
+	for _, tt := range []struct {
+		key    string
+		hashed bool
+	}{
+		{"key", false},
+		{strings.Repeat("k", 10), false},
+		{long, true},
+		{"with space", true},
+		{"ctrl\x01", true},
+		{"__reserved", true},
+	} {
+		got := hashKey(tt.key, 10)
+		if hashed := got != tt.key; hashed != tt.hashed {
+			t.Errorf("hashKey(%q) = %q; want hashed %v", tt.key, got, tt.hashed)
+		}
+		if tt.hashed && (len(got) != 64 || ValidateKey(got, 0) != nil) {
+			t.Errorf("hashKey(%q) = %q; want a valid hex SHA-256", tt.key, got)
+		}
+	}
+	if hashKey(long, 10) != hashKey(long, 10) || hashKey(long, 10) == hashKey(long+"k", 10) {
+		t.Errorf("hashKey is not deterministic and distinct")
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	m := NewMemoryCache(WithClock(clock))
+	c := HashKeys(m, 10)
+	long := strings.Repeat("k", 11)
+	c.Set(ctx, long, []byte("long"), time.Minute)
+	c.Set(ctx, "short", []byte("short"), time.Hour)
+	if got := cached(m, long, "short", hashKey(long, 10)); len(got) != 2 || got[long] {
+		t.Errorf("underlying cache has %v; want short and the hash of the long key", got)
+	}
+	if value, _, err := c.Get(ctx, long); err != nil || string(value) != "long" {
+		t.Errorf("Get(long) = %q, %v; want long", value, err)
+	}
+	clock.advance(2 * time.Minute)
+	if _, _, err := c.Get(ctx, long); err != ErrCacheMiss {
+		t.Errorf("Get(long) after expiry = %v; want ErrCacheMiss", err)
+	}
+	c.Delete(ctx, "short")
+	if m.Len() != 0 {
+		t.Errorf("underlying cache has %d items after Delete; want 0", m.Len())
+	}
+}
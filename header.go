@@ -0,0 +1,72 @@
+package aecache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDeltaSeconds is the largest age in seconds of a Cache-Control
+// directive, beyond which ages are taken as it.
+const maxDeltaSeconds = 1 << 31
+
+// HeaderExpiration returns how long to cache an HTTP response from its
+// Cache-Control and Expires headers, as a shared cache would, and whether to
+// cache it at all. s-maxage takes precedence over max-age, which takes
+// precedence over Expires, relative to Date if set. Responses with
+// no-store, no-cache or private, or already expired, are not cached.
+// Without any of these headers, the response is cached for def.
+// Ages above 2^31 seconds are taken as 2^31 seconds, as RFC 9111 advises.
+// It supports the WithClock option, for the current time of Expires without
+// Date.
+func HeaderExpiration(h http.Header, def time.Duration, opts ...Option) (time.Duration, bool) {
+	var maxAge, sMaxAge string
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			name, value := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			switch name {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				maxAge = value
+			case "s-maxage":
+				sMaxAge = value
+			}
+		}
+	}
+	for _, v := range []string{sMaxAge, maxAge} {
+		if v == "" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange && seconds > 0 {
+			err = nil
+		}
+		if err != nil || seconds <= 0 {
+			return 0, false
+		}
+		if seconds > maxDeltaSeconds {
+			seconds = maxDeltaSeconds
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates, e.g. "0", mean already expired.
+			return 0, false
+		}
+		now := newOptions(opts...).clock.Now()
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		d := expires.Sub(now)
+		return d, d > 0
+	}
+	return def, def > 0
+}
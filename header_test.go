@@ -0,0 +1,42 @@
+package aecache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeaderExpiration(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now().Format(http.TimeFormat)
+	inHour := clock.Now().Add(time.Hour).Format(http.TimeFormat)
+	hourAgo := clock.Now().Add(-time.Hour).Format(http.TimeFormat)
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"none", http.Header{}, time.Minute, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, 0, false},
+		{"no-cache", http.Header{"Cache-Control": {"No-Cache"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"max-age=60", "private"}}, 0, false},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"quoted", http.Header{"Cache-Control": {`max-age="60"`}}, time.Minute, true},
+		{"s-maxage", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"invalid", http.Header{"Cache-Control": {"max-age=soon"}}, 0, false},
+		{"clamped", http.Header{"Cache-Control": {"max-age=9999999999"}}, maxDeltaSeconds * time.Second, true},
+		{"overflow", http.Header{"Cache-Control": {"max-age=99999999999999999999"}}, maxDeltaSeconds * time.Second, true},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {hourAgo}}, time.Minute, true},
+		{"Expires", http.Header{"Expires": {inHour}}, time.Hour, true},
+		{"Expires past", http.Header{"Expires": {hourAgo}}, -time.Hour, false},
+		{"Expires invalid", http.Header{"Expires": {"0"}}, 0, false},
+		{"Expires from Date", http.Header{"Expires": {now}, "Date": {hourAgo}}, time.Hour, true},
+	} {
+		got, ok := HeaderExpiration(tt.header, time.Minute, WithClock(clock))
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("%v: HeaderExpiration() = %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -5,6 +5,11 @@ import "time"
 
 // A CacheItem represents a cached item in Cloud Datastore.
 type CacheItem struct {
-	Value   []byte `datastore:",noindex"`
-	Expires time.Time
+	Value    []byte `datastore:",noindex"`
+	Expires  time.Time
+	Meta     []byte    `datastore:",noindex"`   // JSON, absent for items without
+	Chunks   int       `datastore:",noindex"`   // number of CacheItemChunk children, if chunked
+	Tag      string    `datastore:",omitempty"` // indexed, only with tags enabled
+	Stored   time.Time `datastore:",noindex"`
+	Checksum []byte    `datastore:",noindex"` // CRC-32C of Value, absent for items without
 }
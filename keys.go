@@ -0,0 +1,149 @@
+package aecache
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Key encodes parts into a single key, such that distinct sequences of parts
+// never give the same key, unlike joining them with a delimiter they may
+// contain. Each part is encoded with its kind and length: strings, byte
+// slices, integers, unsigned integers, floats, booleans and times (in UTC) are
+// distinct kinds, integers of any size are the same kind. Other values are
+// encoded with their type and fmt %v, so are distinct only as far as %v is.
+// The key of parts is a prefix of the key of parts with more appended, so
+// DeletePrefix(ctx, Key(parts...)) deletes all keys built from them.
+// Keys may contain any byte, use HashKeys for backends which restrict them.
+func Key(parts ...interface{}) string {
+	var b KeyBuilder
+	for _, p := range parts {
+		b.Add(p)
+	}
+	return b.Key()
+}
+
+// A KeyBuilder builds a key from typed parts, with the encoding of Key.
+// The zero value is an empty key ready to use.
+type KeyBuilder struct {
+	b []byte
+}
+
+// NewKeyBuilder creates a new KeyBuilder.
+func NewKeyBuilder() *KeyBuilder {
+	return &KeyBuilder{}
+}
+
+// String appends a string.
+func (k *KeyBuilder) String(s string) *KeyBuilder {
+	return k.part('s', s)
+}
+
+// Bytes appends a byte slice.
+func (k *KeyBuilder) Bytes(b []byte) *KeyBuilder {
+	return k.part('y', string(b))
+}
+
+// Int appends an integer.
+func (k *KeyBuilder) Int(n int64) *KeyBuilder {
+	return k.part('i', strconv.FormatInt(n, 10))
+}
+
+// Uint appends an unsigned integer.
+func (k *KeyBuilder) Uint(n uint64) *KeyBuilder {
+	return k.part('u', strconv.FormatUint(n, 10))
+}
+
+// Float appends a float.
+func (k *KeyBuilder) Float(f float64) *KeyBuilder {
+	return k.part('f', strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// Bool appends a boolean.
+func (k *KeyBuilder) Bool(v bool) *KeyBuilder {
+	return k.part('b', strconv.FormatBool(v))
+}
+
+// Time appends a time, in UTC so the same instant gives the same key.
+func (k *KeyBuilder) Time(t time.Time) *KeyBuilder {
+	return k.part('t', t.UTC().Format(time.RFC3339Nano))
+}
+
+// Add appends a part of any type, as Key does.
+func (k *KeyBuilder) Add(part interface{}) *KeyBuilder {
+	switch v := part.(type) {
+	case string:
+		return k.String(v)
+	case []byte:
+		return k.Bytes(v)
+	case int:
+		return k.Int(int64(v))
+	case int8:
+		return k.Int(int64(v))
+	case int16:
+		return k.Int(int64(v))
+	case int32:
+		return k.Int(int64(v))
+	case int64:
+		return k.Int(v)
+	case uint:
+		return k.Uint(uint64(v))
+	case uint8:
+		return k.Uint(uint64(v))
+	case uint16:
+		return k.Uint(uint64(v))
+	case uint32:
+		return k.Uint(uint64(v))
+	case uint64:
+		return k.Uint(v)
+	case float32:
+		return k.Float(float64(v))
+	case float64:
+		return k.Float(v)
+	case bool:
+		return k.Bool(v)
+	case time.Time:
+		return k.Time(v)
+	}
+	k.part('v', fmt.Sprintf("%T", part))
+	return k.part('v', fmt.Sprint(part))
+}
+
+// Key returns the key built so far.
+func (k *KeyBuilder) Key() string {
+	return string(k.b)
+}
+
+// part appends a part as its kind, length, a colon and its encoding.
+func (k *KeyBuilder) part(kind byte, s string) *KeyBuilder {
+	k.b = append(k.b, kind)
+	k.b = strconv.AppendInt(k.b, int64(len(s)), 10)
+	k.b = append(k.b, ':')
+	k.b = append(k.b, s...)
+	return k
+}
+
+// keySet returns the set of keys.
+func keySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+// pageKeys sorts keys and returns those after a key, at most limit of them,
+// or all if limit is 0 or less.
+func pageKeys(keys []string, after string, limit int) []string {
+	sort.Strings(keys)
+	i := sort.SearchStrings(keys, after)
+	if i < len(keys) && keys[i] == after {
+		i++
+	}
+	keys = keys[i:]
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
@@ -0,0 +1,288 @@
+package aecache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Loader loads the item for a key from the source of truth on a cache miss.
+// It returns ErrCacheMiss if the key genuinely does not exist.
+type Loader func(ctx context.Context, key string) (Item, error)
+
+// A loadingCache represents a read-through cache: on a miss, it loads items
+// with a Loader and stores them.
+type loadingCache struct {
+	cache    Cache
+	loader   Loader
+	negative time.Duration // how long to remember a key does not exist, 0 to not
+	stale    time.Duration // how long to keep items past expiration, 0 to not
+	clock    Clock
+	flight   flight
+	m        sync.Mutex // protects below
+	missing  map[string]time.Time
+}
+
+// NewLoadingCache creates a read-through cache on top of a Cache.
+// Concurrent loads of the same key are collapsed into one.
+// If negative is positive, keys the loader reports as not existing are
+// remembered as misses for that long.
+// The cache returned is an Invalidator, to forget a key remembered as
+// missing once it exists.
+// It supports the WithClock and WithServeStale options. With the latter, the
+// cache returned is a StaleGetter, and the underlying cache holds items past
+// their expiration, which must not be read from it directly.
+func NewLoadingCache(cache Cache, loader Loader, negative time.Duration, opts ...Option) Cache {
+	o := newOptions(opts...)
+	return &loadingCache{
+		cache:    cache,
+		loader:   loader,
+		negative: negative,
+		stale:    o.serveStale,
+		clock:    o.clock,
+		missing:  make(map[string]time.Time),
+	}
+}
+
+// A StaleGetter gets items, serving expired ones when they cannot be loaded,
+// like a read-through cache with WithServeStale.
+type StaleGetter interface {
+	// GetItemStale gets the item for a key, as GetItem, and whether it is
+	// an expired item returned because loading it failed.
+	GetItemStale(ctx context.Context, key string) (item Item, stale bool, err error)
+}
+
+// Get gets the value and expiration for a key.
+// On a miss, it loads the item and stores it.
+func (a *loadingCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+// On a miss, it loads the item and stores it. With WithServeStale, an
+// expired item is loaded again and, if that fails, returned with its past
+// Expires.
+func (a *loadingCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, _, err := a.GetItemStale(ctx, key)
+	return item, err
+}
+
+// Peek gets the item for a key, without loading it nor modifying the
+// underlying cache if it is a Peeker. With WithServeStale, an expired item is
+// a miss.
+func (a *loadingCache) Peek(ctx context.Context, key string) (Item, error) {
+	item, err := peek(ctx, a.cache, key)
+	if err != nil || a.stale <= 0 {
+		return item, err
+	}
+	item = fresh(item)
+	if item.Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// GetItemStale gets the item for a key, as GetItem, and whether it is an
+// expired item returned because loading it failed.
+// Items are kept in the underlying cache past their expiration, stored in
+// their Meta, so expired ones are not deleted on read until the stale
+// period passes. A key the loader reports as not existing is deleted.
+func (a *loadingCache) GetItemStale(ctx context.Context, key string) (Item, bool, error) {
+	item, err := a.cache.GetItem(ctx, key)
+	if err != nil && err != ErrCacheMiss {
+		return Item{}, false, err
+	}
+	if err == nil {
+		if a.stale <= 0 {
+			return item, false, nil
+		}
+		item = fresh(item)
+		if !item.Expires.Before(a.clock.Now()) {
+			return item, false, nil
+		}
+	} else if a.isMissing(key) {
+		return Item{}, false, ErrCacheMiss
+	}
+	loaded, lerr := a.load(ctx, key)
+	if err == ErrCacheMiss || lerr == nil {
+		return loaded, false, lerr
+	}
+	if lerr == ErrCacheMiss {
+		if err := a.cache.Delete(ctx, key); err != nil {
+			return Item{}, false, err
+		}
+		return Item{}, false, ErrCacheMiss
+	}
+	return item, true, nil
+}
+
+// load loads and stores the item for a key, one load per key at a time.
+func (a *loadingCache) load(ctx context.Context, key string) (Item, error) {
+	return a.flight.Do(key, func() (Item, error) {
+		item, err := a.loader(ctx, key)
+		if err == ErrCacheMiss {
+			a.setMissing(key)
+		}
+		if err != nil {
+			return Item{}, err
+		}
+		if err := a.store(ctx, key, item); err != nil {
+			return Item{}, err
+		}
+		return item, nil
+	})
+}
+
+// store sets a key to an item in the underlying cache, kept for the stale
+// period past its expiration, stored in its Meta, with WithServeStale.
+func (a *loadingCache) store(ctx context.Context, key string, item Item) error {
+	if a.stale <= 0 {
+		return a.cache.SetItem(ctx, key, item)
+	}
+	meta := make(map[string]string, len(item.Meta)+1)
+	for k, v := range item.Meta {
+		meta[k] = v
+	}
+	meta[freshMeta] = item.Expires.Format(time.RFC3339Nano)
+	item.Meta = meta
+	item.Expires = item.Expires.Add(a.stale)
+	return a.cache.SetItem(ctx, key, item)
+}
+
+// Set sets a key to a value with an expiration.
+// It forgets the key was missing.
+func (a *loadingCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if a.stale > 0 {
+		if expiration <= 0 {
+			return nil
+		}
+		return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+	}
+	a.m.Lock()
+	delete(a.missing, key)
+	a.m.Unlock()
+	return a.cache.Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+// It forgets the key was missing.
+func (a *loadingCache) SetItem(ctx context.Context, key string, item Item) error {
+	a.m.Lock()
+	delete(a.missing, key)
+	a.m.Unlock()
+	if a.stale > 0 && item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	return a.store(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+// It does not load the key and forgets it was missing.
+func (a *loadingCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	a.m.Lock()
+	delete(a.missing, key)
+	a.m.Unlock()
+	return a.cache.Add(ctx, key, value, expiration)
+}
+
+// Clean deletes expired items.
+func (a *loadingCache) Clean(ctx context.Context) error {
+	a.m.Lock()
+	now := a.clock.Now()
+	for key, expires := range a.missing {
+		if expires.Before(now) {
+			delete(a.missing, key)
+		}
+	}
+	a.m.Unlock()
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+// It forgets the key was missing.
+func (a *loadingCache) Delete(ctx context.Context, key string) error {
+	return a.DeleteMulti(ctx, []string{key})
+}
+
+// Invalidate removes a key and forgets it was missing, then invalidates it
+// in the underlying cache if it is an Invalidator.
+func (a *loadingCache) Invalidate(ctx context.Context, key string) error {
+	a.m.Lock()
+	delete(a.missing, key)
+	a.m.Unlock()
+	return invalidate(ctx, a.cache, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+// It forgets the key was missing.
+func (a *loadingCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	a.m.Lock()
+	delete(a.missing, key)
+	a.m.Unlock()
+	return deleteIf(ctx, a.cache, key, expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *loadingCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+// It forgets the keys were missing.
+func (a *loadingCache) DeleteMulti(ctx context.Context, keys []string) error {
+	a.m.Lock()
+	for _, key := range keys {
+		delete(a.missing, key)
+	}
+	a.m.Unlock()
+	return a.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+// It forgets such keys were missing.
+func (a *loadingCache) DeletePrefix(ctx context.Context, prefix string) error {
+	a.m.Lock()
+	for key := range a.missing {
+		if strings.HasPrefix(key, prefix) {
+			delete(a.missing, key)
+		}
+	}
+	a.m.Unlock()
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+// Keys remembered as missing have no item, so they are kept.
+func (a *loadingCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// isMissing tells whether a key is remembered as not existing.
+func (a *loadingCache) isMissing(key string) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	expires, ok := a.missing[key]
+	return ok && !expires.Before(a.clock.Now())
+}
+
+// setMissing remembers a key does not exist.
+func (a *loadingCache) setMissing(key string) {
+	if a.negative <= 0 {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.missing[key] = a.clock.Now().Add(a.negative)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *loadingCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
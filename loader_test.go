@@ -0,0 +1,160 @@
+package aecache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A source is a Loader over a map, counting loads.
+type source struct {
+	m     sync.Mutex
+	items map[string]string
+	loads int
+}
+
+func newSource() *source {
+	return &source{items: make(map[string]string)}
+}
+
+func (s *source) put(key, value string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.items[key] = value
+}
+
+func (s *source) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.loads
+}
+
+// loader returns a Loader of the source, items expiring after expiration.
+func (s *source) loader(clock Clock, expiration time.Duration) Loader {
+	return func(ctx context.Context, key string) (Item, error) {
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.loads++
+		value, ok := s.items[key]
+		if !ok {
+			return Item{}, ErrCacheMiss
+		}
+		return Item{Value: []byte(value), Expires: clock.Now().Add(expiration)}, nil
+	}
+}
+
+func TestLoadingCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	for _, tt := range []struct {
+		name string
+		// wrap returns a cache with a loading cache made by loading.
+		wrap func(loading func(Cache) Cache) Cache
+	}{
+		{"outer", func(loading func(Cache) Cache) Cache {
+			return loading(NewCombinedCache([]Cache{NewMemoryCache(WithClock(clock))}, WithClock(clock)))
+		}},
+		{"layer", func(loading func(Cache) Cache) Cache {
+			return NewCombinedCache([]Cache{loading(NewMemoryCache(WithClock(clock)))}, WithClock(clock))
+		}},
+		{"wrapped", func(loading func(Cache) Cache) Cache {
+			return HashKeys(Timed(loading(NewMemoryCache(WithClock(clock))), "loading", recordNothing{}), 250)
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newSource()
+			c := tt.wrap(func(c Cache) Cache {
+				return NewLoadingCache(c, src.loader(clock, time.Hour), time.Hour, WithClock(clock))
+			})
+			if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss {
+				t.Fatalf("GetItem() = %v, want ErrCacheMiss", err)
+			}
+			src.put("k", "v")
+			if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss {
+				t.Fatalf("GetItem() = %v, want ErrCacheMiss remembered", err)
+			}
+			if err := c.(Invalidator).Invalidate(ctx, "k"); err != nil {
+				t.Fatal(err)
+			}
+			if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "v" {
+				t.Errorf("GetItem() after Invalidate = %q, %v; want v", item.Value, err)
+			}
+		})
+	}
+}
+
+func TestLoadingCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	src := newSource()
+	src.put("k", "v")
+	c := NewLoadingCache(NewMemoryCache(WithClock(clock)), src.loader(clock, time.Minute), 0, WithClock(clock))
+	for i := 0; i < 3; i++ {
+		if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "v" {
+			t.Fatalf("GetItem() = %q, %v; want v", item.Value, err)
+		}
+	}
+	if n := src.count(); n != 1 {
+		t.Errorf("loaded %d times; want once", n)
+	}
+	clock.advance(2 * time.Minute)
+	c.GetItem(ctx, "k")
+	if n := src.count(); n != 2 {
+		t.Errorf("loaded %d times after expiry; want twice", n)
+	}
+}
+
+func TestLoadingCacheNegativeExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	src := newSource()
+	c := NewLoadingCache(NewMemoryCache(WithClock(clock)), src.loader(clock, time.Hour), time.Minute, WithClock(clock))
+	c.GetItem(ctx, "k")
+	src.put("k", "v")
+	if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss || src.count() != 1 {
+		t.Errorf("GetItem() = %v after %d loads; want ErrCacheMiss remembered", err, src.count())
+	}
+	clock.advance(2 * time.Minute)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "v" {
+		t.Errorf("GetItem() after the negative TTL = %q, %v; want v", item.Value, err)
+	}
+}
+
+func TestLoadingCacheServeStale(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	var loadErr error
+	loader := func(ctx context.Context, key string) (Item, error) {
+		if loadErr != nil {
+			return Item{}, loadErr
+		}
+		return Item{Value: []byte("v"), Expires: clock.Now().Add(time.Minute)}, nil
+	}
+	c := NewLoadingCache(NewMemoryCache(WithClock(clock)), loader, 0, WithClock(clock), WithServeStale(time.Hour))
+	expires := clock.Now().Add(time.Minute)
+	c.GetItem(ctx, "k")
+	loadErr = errors.New("source down")
+	clock.advance(2 * time.Minute)
+	item, stale, err := c.(StaleGetter).GetItemStale(ctx, "k")
+	if err != nil || !stale || string(item.Value) != "v" || !item.Expires.Equal(expires) {
+		t.Errorf("GetItemStale() = %q expiring %v, %v, %v; want stale v expired at %v", item.Value, item.Expires, stale, err, expires)
+	}
+	if _, err := c.(Peeker).Peek(ctx, "k"); err != ErrCacheMiss {
+		t.Errorf("Peek() of an expired item = %v; want ErrCacheMiss", err)
+	}
+	// Past the stale period, the load error is returned.
+	clock.advance(time.Hour)
+	if _, err := c.GetItem(ctx, "k"); err != loadErr {
+		t.Errorf("GetItem() past the stale period = %v; want %v", err, loadErr)
+	}
+	// A key the loader reports as not existing is not served stale.
+	loadErr = nil
+	c.GetItem(ctx, "k")
+	clock.advance(2 * time.Minute)
+	loadErr = ErrCacheMiss
+	if _, err := c.GetItem(ctx, "k"); err != ErrCacheMiss {
+		t.Errorf("GetItem() of a key gone = %v; want ErrCacheMiss", err)
+	}
+}
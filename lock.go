@@ -0,0 +1,50 @@
+package aecache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrNotLocked is when unlocking a lock no longer held, because it expired
+// and possibly was acquired by someone else.
+var ErrNotLocked = errors.New("cache: not locked")
+
+// Lock tries to acquire a lock on a key in a cache, using Add to claim it
+// with a random token as value. The ttl bounds how long the lock is held if
+// the holder crashes without unlocking.
+// It returns whether the lock was acquired and, if so, a function to
+// release it. Unlock deletes the key only if it still holds the token, with
+// DeleteIf in one atomic step, so a holder whose lock expired cannot release
+// a lock since acquired by someone else. It returns ErrNotLocked if the lock
+// is no longer held.
+// Lock returns ErrNotSupported without trying to acquire the lock if the
+// cache cannot delete conditionally, see ConditionalDeleter, as the lock
+// could then not be released before its ttl.
+func Lock(ctx context.Context, c Cache, key string, ttl time.Duration) (unlock func(ctx context.Context) error, acquired bool, err error) {
+	if !canDeleteIf(c) {
+		return nil, false, ErrNotSupported
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, err
+	}
+	token := []byte(hex.EncodeToString(b))
+	acquired, err = c.Add(ctx, key, token, ttl)
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+	unlock = func(ctx context.Context) error {
+		deleted, err := deleteIf(ctx, c, key, token)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return ErrNotLocked
+		}
+		return nil
+	}
+	return unlock, true, nil
+}
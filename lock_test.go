@@ -0,0 +1,114 @@
+package aecache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordNothing is a Recorder discarding durations, to wrap with Timed.
+type recordNothing struct{}
+
+func (recordNothing) Record(layer, op string, d time.Duration) {}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bolt, err := NewBoltCache(filepath.Join(dir, "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		c    Cache
+	}{
+		{"memory", NewMemoryCache()},
+		{"syncmap", NewSyncMapCache()},
+		{"sharded", NewShardedMemoryCache(4)},
+		{"bolt", bolt},
+		{"combined", NewCombinedCache([]Cache{NewMemoryCache(), NewSyncMapCache()})},
+		{"hashed", HashKeys(NewMemoryCache(), 8)},
+		{"prefixed", WithPrefix(NewMemoryCache(), "p")},
+		{"timed", Timed(NewMemoryCache(), "memory", recordNothing{})},
+		{"router", NewRouter(func(string) Cache { return nil }, NewMemoryCache())},
+		{"replicated", NewReplicatedCache([]Cache{NewMemoryCache(), NewSyncMapCache()})},
+		{"fallback", &FallbackCache{cache: NewMemoryCache(), active: true}},
+		{"loading", NewLoadingCache(NewMemoryCache(), func(ctx context.Context, key string) (Item, error) {
+			return Item{}, ErrCacheMiss
+		}, 0)},
+		{"nested", WithPrefix(HashKeys(NewCombinedCache([]Cache{
+			NewMemoryCache(),
+			Timed(NewShardedMemoryCache(2), "sharded", recordNothing{}),
+		}), 8), "p")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unlock, acquired, err := Lock(ctx, tt.c, "cron", time.Minute)
+			if err != nil || !acquired {
+				t.Fatalf("Lock() = %v, %v; want acquired", acquired, err)
+			}
+			if _, acquired, err := Lock(ctx, tt.c, "cron", time.Minute); err != nil || acquired {
+				t.Fatalf("Lock() while held = %v, %v; want not acquired", acquired, err)
+			}
+			if err := unlock(ctx); err != nil {
+				t.Fatalf("unlock() = %v", err)
+			}
+			if err := unlock(ctx); err != ErrNotLocked {
+				t.Errorf("unlock() again = %v, want ErrNotLocked", err)
+			}
+			if _, acquired, err := Lock(ctx, tt.c, "cron", time.Minute); err != nil || !acquired {
+				t.Errorf("Lock() after unlock = %v, %v; want acquired", acquired, err)
+			}
+		})
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	c := NewCombinedCache([]Cache{NewMemoryCache(WithClock(clock))}, WithClock(clock))
+	unlock, acquired, err := Lock(ctx, c, "cron", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("Lock() = %v, %v; want acquired", acquired, err)
+	}
+	clock.advance(2 * time.Minute)
+	if _, acquired, err := Lock(ctx, c, "cron", time.Minute); err != nil || !acquired {
+		t.Fatalf("Lock() after expiry = %v, %v; want acquired", acquired, err)
+	}
+	if err := unlock(ctx); err != ErrNotLocked {
+		t.Errorf("unlock() of an expired lock = %v, want ErrNotLocked", err)
+	}
+	if _, acquired, _ := Lock(ctx, c, "cron", time.Minute); acquired {
+		t.Errorf("Lock() acquired: the expired holder released the new lock")
+	}
+}
+
+func TestLockNotSupported(t *testing.T) {
+	ctx := WithRequestCache(context.Background())
+	for _, tt := range []struct {
+		name string
+		c    Cache
+	}{
+		{"request", NewRequestCache()},
+		{"combined", NewCombinedCache([]Cache{NewMemoryCache(), NewRequestCache()})},
+		{"empty", NewCombinedCache(nil)},
+		{"prefixed", WithPrefix(NewRequestCache(), "p")},
+		{"router", NewRouter(func(string) Cache { return nil }, NewMemoryCache(), NewRequestCache())},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, acquired, err := Lock(ctx, tt.c, "cron", time.Minute); err != ErrNotSupported || acquired {
+				t.Errorf("Lock() = %v, %v; want ErrNotSupported", acquired, err)
+			}
+			if _, err := tt.c.GetItem(ctx, "cron"); err != ErrCacheMiss {
+				t.Errorf("GetItem() = %v, want ErrCacheMiss: Lock added the key", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package aecache
+
+import "log"
+
+// logf logs to a logger set with WithLogger, if any.
+func logf(l *log.Logger, format string, v ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.Printf(format, v...)
+}
@@ -1,64 +1,670 @@
 package aecache
 
 import (
+	"bytes"
+	"container/heap"
+	"container/list"
 	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// A memoryCache represents a cache in the process memory.
-type memoryCache struct {
-	m       sync.Mutex // protects below
-	values  map[string][]byte
-	expires map[string]time.Time
+// A MemoryCache represents a cache in the process memory.
+type MemoryCache struct {
+	clock    Clock
+	maxBytes int // 0 means unbounded
+	onEvict  func(ctx context.Context, key string, item Item, reason EvictReason)
+	hot      uint64 // hits from which an evicted item is hot
+	onHot    func(ctx context.Context, key string)
+	maxIdle  time.Duration  // since last access, 0 for none
+	logger   *log.Logger    // for evictions, nil for none
+	compact  float64        // ratio of items to peak under which to compact, 0 for never
+	policy   EvictionPolicy // chooses victims, nil for soonest expiration then LRU
+	m        sync.Mutex     // protects below
+	items    map[string]*memoryItem
+	peak     int                            // most items since items was allocated
+	tags     map[string]map[string]struct{} // tag to keys, for DeleteByTag
+	ttl      ttlHeap                        // by expiration then LRU, to clean and evict without scanning
+	idle     *list.List                     // of *memoryItem, last accessed at the back, with maxIdle
+	bytes    int                            // summed length of values
+	tick     uint64                         // incremented on each access, for LRU
+	evicted  []eviction                     // pending onEvict notifications
+	stats    Stats
 }
 
-// newMemoryCache creates a new memoryCache.
-func newMemoryCache() *memoryCache {
-	return &memoryCache{
-		values:  make(map[string][]byte),
-		expires: make(map[string]time.Time),
+// A memoryItem represents an item in a MemoryCache.
+type memoryItem struct {
+	Item
+	key      string
+	index    int           // in the ttl heap
+	idle     *list.Element // in the idle list, with maxIdle
+	used     uint64        // tick of last access
+	accessed time.Time     // last set or get, for maxIdle
+	hits     uint64        // gets while cached
+}
+
+// NewMemoryCache creates a new MemoryCache.
+func NewMemoryCache(opts ...Option) *MemoryCache {
+	o := newOptions(opts...)
+	a := &MemoryCache{
+		clock:    o.clock,
+		maxBytes: o.maxBytes,
+		onEvict:  o.onEvict,
+		hot:      o.hotThreshold,
+		onHot:    o.onEvictHot,
+		maxIdle:  o.maxIdle,
+		logger:   o.logger,
+		compact:  o.compact,
+		items:    make(map[string]*memoryItem),
+		tags:     make(map[string]map[string]struct{}),
+	}
+	if o.newPolicy != nil {
+		a.policy = o.newPolicy()
+	}
+	if a.maxIdle > 0 {
+		a.idle = list.New()
+	}
+	return a
+}
+
+// NewMemoryLayer creates a new cache layer in the process memory: a
+// MemoryCache, or with WithSyncMap a SyncMapCache, so the implementation is
+// chosen by configuration.
+func NewMemoryLayer(opts ...Option) Cache {
+	if newOptions(opts...).syncMap {
+		return NewSyncMapCache(opts...)
 	}
+	return NewMemoryCache(opts...)
 }
 
 // Set sets a key to a value with an expiration.
-func (a *memoryCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+// With a byte budget, items are evicted to make room: soonest expiration
+// first, then least recently used, or as chosen by WithEvictionPolicy.
+func (a *MemoryCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
 	if expiration <= 0 {
 		return nil
 	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *MemoryCache) SetItem(ctx context.Context, key string, item Item) error {
+	if a.maxBytes > 0 && len(item.Value) > a.maxBytes {
+		return ErrTooBig
+	}
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	a.set(ctx, key, item)
+	return nil
+}
+
+// SetItemIfLonger sets a key to an item, unless it is already expired or the
+// key is set to an item not expired which expires later. The expiration is
+// thus only extended, never shortened: when writers propose different
+// expirations, the longest wins.
+func (a *MemoryCache) SetItemIfLonger(ctx context.Context, key string, item Item) error {
+	if a.maxBytes > 0 && len(item.Value) > a.maxBytes {
+		return ErrTooBig
+	}
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	if item.Expires.Before(now) {
+		return nil
+	}
+	if e, ok := a.items[key]; ok && !a.expired(e, now) && e.Expires.After(item.Expires) {
+		return nil
+	}
+	a.set(ctx, key, item)
+	return nil
+}
+
+// LoadOrStoreItem returns the item of a key if set and not expired, with
+// loaded true. Otherwise it sets the key to item, unless already expired, and
+// returns it with loaded false. It is atomic, as sync.Map.LoadOrStore.
+func (a *MemoryCache) LoadOrStoreItem(ctx context.Context, key string, item Item) (actual Item, loaded bool, err error) {
+	if a.maxBytes > 0 && len(item.Value) > a.maxBytes {
+		return Item{}, false, ErrTooBig
+	}
+	defer a.notify()
 	a.m.Lock()
 	defer a.m.Unlock()
-	a.values[key] = value
-	a.expires[key] = time.Now().Add(expiration)
+	now := a.clock.Now()
+	if e, ok := a.items[key]; ok && !a.expired(e, now) {
+		return e.Item, true, nil
+	}
+	if item.Expires.Before(now) {
+		return item, false, nil
+	}
+	a.set(ctx, key, item)
+	return a.items[key].Item, false, nil
+}
+
+// SetItemMulti sets keys to items, skipping those already expired, under
+// one lock.
+func (a *MemoryCache) SetItemMulti(ctx context.Context, items map[string]Item) error {
+	if a.maxBytes > 0 {
+		for _, item := range items {
+			if len(item.Value) > a.maxBytes {
+				return ErrTooBig
+			}
+		}
+	}
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	for key, item := range items {
+		if !item.Expires.Before(now) {
+			a.set(ctx, key, item)
+		}
+	}
 	return nil
 }
 
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *MemoryCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		return false, nil
+	}
+	if a.maxBytes > 0 && len(value) > a.maxBytes {
+		return false, ErrTooBig
+	}
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	if item, ok := a.items[key]; ok && !a.expired(item, now) {
+		return false, nil
+	}
+	a.set(ctx, key, Item{Value: value, Expires: now.Add(expiration)})
+	return true, nil
+}
+
+// set sets a key to an item, evicting to make room.
+// The lock must be held.
+func (a *MemoryCache) set(ctx context.Context, key string, item Item) {
+	item = stamp(ctx, item, a.clock.Now())
+	a.remove(key)
+	if a.maxBytes > 0 {
+		for a.bytes+len(item.Value) > a.maxBytes {
+			a.evict(ctx, a.victim(), EvictCapacity)
+		}
+	}
+	a.tick++
+	e := &memoryItem{Item: item, key: key, used: a.tick, accessed: a.clock.Now()}
+	a.items[key] = e
+	if a.policy != nil {
+		a.policy.RecordWrite(key, len(item.Value))
+	}
+	if len(a.items) > a.peak {
+		a.peak = len(a.items)
+	}
+	if tag := item.Meta[TagMeta]; tag != "" {
+		if a.tags[tag] == nil {
+			a.tags[tag] = make(map[string]struct{})
+		}
+		a.tags[tag][key] = struct{}{}
+	}
+	heap.Push(&a.ttl, e)
+	if a.idle != nil {
+		e.idle = a.idle.PushFront(e)
+	}
+	a.bytes += len(item.Value)
+}
+
 // Get gets the value and expiration for a key.
-func (a *memoryCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+func (a *MemoryCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+func (a *MemoryCache) GetItem(ctx context.Context, key string) (Item, error) {
+	defer a.notify()
 	a.m.Lock()
 	defer a.m.Unlock()
-	value, okv := a.values[key]
-	expires, oke := a.expires[key]
-	if !okv || !oke {
-		return nil, time.Time{}, ErrCacheMiss
+	item, ok := a.items[key]
+	if !ok {
+		a.stats.Misses++
+		return Item{}, ErrCacheMiss
+	}
+	now := a.clock.Now()
+	if a.expired(item, now) {
+		a.evict(ctx, key, EvictExpired)
+		a.stats.Misses++
+		return Item{}, ErrCacheMiss
+	}
+	a.stats.Hits++
+	a.tick++
+	item.used = a.tick
+	heap.Fix(&a.ttl, item.index)
+	item.accessed = now
+	if a.idle != nil {
+		a.idle.MoveToFront(item.idle)
 	}
-	if expires.Before(time.Now()) {
-		delete(a.values, key)
-		delete(a.expires, key)
-		return nil, time.Time{}, ErrCacheMiss
+	item.hits++
+	if a.policy != nil {
+		a.policy.RecordAccess(key)
 	}
-	return value, expires, nil
+	return item.Item, nil
+}
+
+// Peek gets the item for a key, without deleting it if expired nor updating
+// its recency.
+func (a *MemoryCache) Peek(ctx context.Context, key string) (Item, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	item, ok := a.items[key]
+	if !ok || a.expired(item, a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return item.Item, nil
+}
+
+// TTLs returns the remaining time to live of keys, omitting those missing or
+// expired. It holds the lock once for all keys.
+func (a *MemoryCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	ttls := make(map[string]time.Duration)
+	for _, key := range keys {
+		if item, ok := a.items[key]; ok && !a.expired(item, now) {
+			ttls[key] = a.deadline(item).Sub(now)
+		}
+	}
+	return ttls, nil
 }
 
 // Clean deletes expired items.
-func (a *memoryCache) Clean(ctx context.Context) error {
+// It only visits expired items, soonest expiration first, then with
+// WithMaxIdle idle items, least recently accessed first.
+func (a *MemoryCache) Clean(ctx context.Context) error {
+	defer a.notify()
 	a.m.Lock()
 	defer a.m.Unlock()
-	for key, expires := range a.expires {
-		if expires.Before(time.Now()) {
-			delete(a.values, key)
-			delete(a.expires, key)
+	now := a.clock.Now()
+	for len(a.ttl) > 0 && a.ttl[0].Expires.Before(now) {
+		a.evict(ctx, a.ttl[0].key, EvictExpired)
+	}
+	for a.idle != nil && a.idle.Len() > 0 {
+		item := a.idle.Back().Value.(*memoryItem)
+		if !item.accessed.Add(a.maxIdle).Before(now) {
+			break
+		}
+		a.evict(ctx, item.key, EvictExpired)
+	}
+	if a.compact > 0 && float64(len(a.items)) < a.compact*float64(a.peak) {
+		a.compactItems()
+	}
+	return nil
+}
+
+// compactItems copies the items, the tags and the ttl heap to new maps and
+// slices, so the memory of the buckets and elements of deleted keys is
+// reclaimed.
+// The lock must be held.
+func (a *MemoryCache) compactItems() {
+	items := make(map[string]*memoryItem, len(a.items))
+	for key, item := range a.items {
+		items[key] = item
+	}
+	a.items = items
+	a.peak = len(items)
+	tags := make(map[string]map[string]struct{}, len(a.tags))
+	for tag, keys := range a.tags {
+		tags[tag] = make(map[string]struct{}, len(keys))
+		for key := range keys {
+			tags[tag][key] = struct{}{}
 		}
 	}
+	a.tags = tags
+	a.ttl = append(make(ttlHeap, 0, len(a.ttl)), a.ttl...)
+}
+
+// deadline returns when an item expires: at its expiration, or earlier once
+// idle for maxIdle.
+func (a *MemoryCache) deadline(item *memoryItem) time.Time {
+	if a.maxIdle > 0 {
+		if idle := item.accessed.Add(a.maxIdle); idle.Before(item.Expires) {
+			return idle
+		}
+	}
+	return item.Expires
+}
+
+// expired tells whether an item is expired, or idle for more than maxIdle.
+func (a *MemoryCache) expired(item *memoryItem, now time.Time) bool {
+	return a.deadline(item).Before(now)
+}
+
+// Delete deletes a key.
+func (a *MemoryCache) Delete(ctx context.Context, key string) error {
+	return a.DeleteMulti(ctx, []string{key})
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected, atomically. It returns whether the key was deleted.
+func (a *MemoryCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	item, ok := a.items[key]
+	if !ok || a.expired(item, a.clock.Now()) || !bytes.Equal(item.Value, expected) {
+		return false, nil
+	}
+	a.evict(ctx, key, EvictDeleted)
+	return true, nil
+}
+
+// DeleteMulti deletes keys.
+func (a *MemoryCache) DeleteMulti(ctx context.Context, keys []string) error {
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	for _, key := range keys {
+		a.evict(ctx, key, EvictDeleted)
+	}
 	return nil
 }
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *MemoryCache) DeletePrefix(ctx context.Context, prefix string) error {
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	for key := range a.items {
+		if strings.HasPrefix(key, prefix) {
+			a.evict(ctx, key, EvictDeleted)
+		}
+	}
+	return nil
+}
+
+// FlushExcept deletes all items but those of the keys to keep, under the
+// lock, e.g. to reset the cache but keep configuration.
+func (a *MemoryCache) FlushExcept(ctx context.Context, keep ...string) error {
+	keys := keySet(keep)
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	for key := range a.items {
+		if _, ok := keys[key]; !ok {
+			a.evict(ctx, key, EvictDeleted)
+		}
+	}
+	return nil
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+// Tagged items are indexed, at the cost of a map entry per tagged key.
+func (a *MemoryCache) DeleteByTag(ctx context.Context, tag string) error {
+	defer a.notify()
+	a.m.Lock()
+	defer a.m.Unlock()
+	for key := range a.tags[tag] {
+		a.evict(ctx, key, EvictDeleted)
+	}
+	return nil
+}
+
+// Ping checks the cache is healthy, which it always is.
+func (a *MemoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Name returns the name of the layer.
+func (a *MemoryCache) Name() string {
+	return "memory"
+}
+
+// Len returns the number of items in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *MemoryCache) Len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return len(a.items)
+}
+
+// Bytes returns the summed length of the values in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *MemoryCache) Bytes() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.bytes
+}
+
+// SortedKeys returns the keys of the items not expired, in sorted order.
+func (a *MemoryCache) SortedKeys(ctx context.Context) ([]string, error) {
+	return a.KeysPage(ctx, "", 0)
+}
+
+// ScanPrefix returns the keys of the items not expired starting with prefix,
+// in sorted order.
+func (a *MemoryCache) ScanPrefix(ctx context.Context, prefix string) ([]string, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	var keys []string
+	for key, item := range a.items {
+		if strings.HasPrefix(key, prefix) && !a.expired(item, now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// KeysPage returns the keys of the items not expired in sorted order, after
+// a key and at most limit of them, or all if limit is 0. Browse a large cache
+// by passing the last key of a page to get the next one.
+func (a *MemoryCache) KeysPage(ctx context.Context, after string, limit int) ([]string, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	var keys []string
+	for key, item := range a.items {
+		if key > after && !a.expired(item, now) {
+			keys = append(keys, key)
+		}
+	}
+	return pageKeys(keys, after, limit), nil
+}
+
+// Hits returns the number of gets of a key since it was set, 0 if it is not
+// cached. See WithOnEvictHot.
+func (a *MemoryCache) Hits(key string) uint64 {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if item, ok := a.items[key]; ok {
+		return item.hits
+	}
+	return 0
+}
+
+// Stats returns the counters of the cache.
+func (a *MemoryCache) Stats() Stats {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.stats
+}
+
+// victim returns the key to evict: the victim of the policy if it knows one
+// cached, otherwise soonest expiration, then least recently used, at the top
+// of the ttl heap.
+// The lock must be held and the cache not empty.
+func (a *MemoryCache) victim() string {
+	for a.policy != nil {
+		key, ok := a.policy.Victim()
+		if !ok {
+			break
+		}
+		if _, ok := a.items[key]; ok {
+			return key
+		}
+		a.policy.RecordRemove(key)
+	}
+	return a.ttl[0].key
+}
+
+// remove deletes a key and updates the size accounting.
+// The lock must be held.
+func (a *MemoryCache) remove(key string) {
+	item, ok := a.items[key]
+	if !ok {
+		return
+	}
+	a.bytes -= len(item.Value)
+	delete(a.items, key)
+	heap.Remove(&a.ttl, item.index)
+	if a.idle != nil {
+		a.idle.Remove(item.idle)
+	}
+	if a.policy != nil {
+		a.policy.RecordRemove(key)
+	}
+	if tag := item.Meta[TagMeta]; tag != "" {
+		delete(a.tags[tag], key)
+		if len(a.tags[tag]) == 0 {
+			delete(a.tags, tag)
+		}
+	}
+}
+
+// evict removes a key and queues an onEvict notification.
+// The lock must be held.
+func (a *MemoryCache) evict(ctx context.Context, key string, reason EvictReason) {
+	item, ok := a.items[key]
+	if !ok {
+		return
+	}
+	a.remove(key)
+	if reason != EvictDeleted {
+		a.stats.Evictions++
+	}
+	if a.onEvict != nil || a.onHot != nil || a.logger != nil {
+		a.evicted = append(a.evicted, eviction{
+			ctx:    ctx,
+			key:    key,
+			item:   item.Item,
+			reason: reason,
+			hits:   item.hits,
+		})
+	}
+}
+
+// notify calls onEvict, and onHot for hot items evicted for capacity, for
+// the pending evictions, and logs them.
+// The lock must not be held, so the callback may call back into the cache.
+func (a *MemoryCache) notify() {
+	if a.onEvict == nil && a.onHot == nil && a.logger == nil {
+		return
+	}
+	a.m.Lock()
+	evicted := a.evicted
+	a.evicted = nil
+	a.m.Unlock()
+	for _, e := range evicted {
+		logf(a.logger, "aecache: memory: evicted %q: %v", e.key, e.reason)
+		if a.onEvict != nil {
+			a.onEvict(e.ctx, e.key, e.item, e.reason)
+		}
+		if a.onHot != nil && e.reason == EvictCapacity && e.hits >= a.hot {
+			a.onHot(e.ctx, e.key)
+		}
+	}
+}
+
+// Snapshot returns a copy of the items not expired.
+// It can be saved and given to WarmUp to reload the cache on startup.
+func (a *MemoryCache) Snapshot(ctx context.Context) (map[string]Item, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	items := make(map[string]Item, len(a.items))
+	for key, item := range a.items {
+		if a.expired(item, now) {
+			continue
+		}
+		items[key] = item.Item
+	}
+	return items, nil
+}
+
+// A jsonItem represents an item exported by ExportJSON, one per line.
+// The value is encoded in base64.
+type jsonItem struct {
+	Key     string            `json:"key"`
+	Value   []byte            `json:"value"`
+	Expires time.Time         `json:"expires"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Stored  time.Time         `json:"stored"`
+}
+
+// ExportJSON writes the items not expired to w as a stream of JSON objects,
+// one per line, with the key, base64 value and expiration.
+// It is meant for debugging: operators can inspect the cache, and restore it
+// with ImportJSON. Items are written outside the lock, one at a time.
+func (a *MemoryCache) ExportJSON(ctx context.Context, w io.Writer) error {
+	a.m.Lock()
+	now := a.clock.Now()
+	keys := make([]string, 0, len(a.items))
+	items := make([]*memoryItem, 0, len(a.items))
+	for key, item := range a.items {
+		if a.expired(item, now) {
+			continue
+		}
+		keys = append(keys, key)
+		items = append(items, item)
+	}
+	a.m.Unlock()
+	enc := json.NewEncoder(w)
+	for i, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(jsonItem{
+			Key:     keys[i],
+			Value:   item.Value,
+			Expires: item.Expires,
+			Meta:    item.Meta,
+			Stored:  item.Stored,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSON reads items written by ExportJSON from r and sets them,
+// skipping those already expired. Items are set as they are read, keeping
+// when they were stored, so GetItemIfNewer still compares the originals.
+func (a *MemoryCache) ImportJSON(ctx context.Context, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e jsonItem
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := a.SetItem(withRefill(ctx), e.Key, Item{Value: e.Value, Expires: e.Expires, Meta: e.Meta, Stored: e.Stored}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// A fakeClock is a Clock whose time only moves when told.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// cached returns which of keys are cached, peeking so recency is kept.
+func cached(a *MemoryCache, keys ...string) map[string]bool {
+	got := make(map[string]bool)
+	for _, key := range keys {
+		if _, err := a.Peek(context.Background(), key); err == nil {
+			got[key] = true
+		}
+	}
+	return got
+}
+
+func TestMemoryCacheEvictsSoonestExpiration(t *testing.T) {
+	ctx := context.Background()
+	a := NewMemoryCache(WithClock(newFakeClock()), WithMaxBytes(12))
+	a.Set(ctx, "b", []byte("bbbb"), 2*time.Hour)
+	a.Set(ctx, "a", []byte("aaaa"), time.Hour)
+	a.Set(ctx, "c", []byte("cccc"), 3*time.Hour)
+	a.Set(ctx, "d", []byte("dddd"), 4*time.Hour)
+	if got := cached(a, "a", "b", "c", "d"); got["a"] || !got["b"] || !got["c"] || !got["d"] {
+		t.Errorf("cached = %v, want a evicted, expiring first", got)
+	}
+	a.Set(ctx, "e", []byte("eeeeeeee"), 5*time.Hour)
+	if got := cached(a, "b", "c", "d", "e"); got["b"] || got["c"] || !got["d"] || !got["e"] {
+		t.Errorf("cached = %v, want b and c evicted, expiring first", got)
+	}
+	if got, want := a.Bytes(), 12; got != want {
+		t.Errorf("Bytes() = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewMemoryCache(WithClock(clock), WithMaxBytes(8))
+	expires := clock.Now().Add(time.Hour)
+	a.SetItem(ctx, "a", Item{Value: []byte("aaaa"), Expires: expires})
+	a.SetItem(ctx, "b", Item{Value: []byte("bbbb"), Expires: expires})
+	if _, err := a.GetItem(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	a.SetItem(ctx, "c", Item{Value: []byte("cccc"), Expires: expires})
+	if got := cached(a, "a", "b", "c"); !got["a"] || got["b"] || !got["c"] {
+		t.Errorf("cached = %v, want b evicted, least recently used", got)
+	}
+}
+
+func TestMemoryCacheEvictsOverwrittenItems(t *testing.T) {
+	ctx := context.Background()
+	a := NewMemoryCache(WithClock(newFakeClock()), WithMaxBytes(8))
+	a.Set(ctx, "a", []byte("aaaa"), time.Hour)
+	a.Set(ctx, "b", []byte("bbbb"), 2*time.Hour)
+	// a now expires last, so b is evicted first.
+	a.Set(ctx, "a", []byte("aaaa"), 3*time.Hour)
+	a.Set(ctx, "c", []byte("cccc"), 4*time.Hour)
+	if got := cached(a, "a", "b", "c"); !got["a"] || got["b"] || !got["c"] {
+		t.Errorf("cached = %v, want b evicted", got)
+	}
+}
+
+func TestMemoryCacheClean(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewMemoryCache(WithClock(clock))
+	a.Set(ctx, "a", []byte("a"), time.Minute)
+	a.Set(ctx, "b", []byte("b"), time.Hour)
+	a.Set(ctx, "c", []byte("c"), time.Minute)
+	a.Delete(ctx, "c")
+	clock.advance(2 * time.Minute)
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.Len(), 1; got != want {
+		t.Errorf("Len() after Clean = %v, want %v", got, want)
+	}
+	if got := cached(a, "a", "b"); got["a"] || !got["b"] {
+		t.Errorf("cached = %v, want a cleaned", got)
+	}
+}
+
+func TestMemoryCacheSetItemIfLonger(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewMemoryCache(WithClock(clock), WithMaxIdle(time.Minute))
+	now := clock.Now()
+	a.SetItem(ctx, "k", Item{Value: []byte("long"), Expires: now.Add(time.Hour)})
+	a.SetItemIfLonger(ctx, "k", Item{Value: []byte("short"), Expires: now.Add(30 * time.Minute)})
+	if item, err := a.Peek(ctx, "k"); err != nil || string(item.Value) != "long" {
+		t.Fatalf("Peek() = %q, %v; want long kept", item.Value, err)
+	}
+	// Once idle, the longer item is expired and no longer blocks the set.
+	clock.advance(2 * time.Minute)
+	a.SetItemIfLonger(ctx, "k", Item{Value: []byte("short"), Expires: clock.Now().Add(30 * time.Minute)})
+	if item, err := a.Peek(ctx, "k"); err != nil || string(item.Value) != "short" {
+		t.Errorf("Peek() = %q, %v; want short set over idle item", item.Value, err)
+	}
+}
+
+func TestMemoryCacheCleanIdle(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewMemoryCache(WithClock(clock), WithMaxIdle(time.Minute))
+	a.Set(ctx, "a", []byte("a"), time.Hour)
+	a.Set(ctx, "b", []byte("b"), time.Hour)
+	a.Set(ctx, "c", []byte("c"), time.Hour)
+	clock.advance(45 * time.Second)
+	if _, err := a.GetItem(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	a.Delete(ctx, "c")
+	clock.advance(30 * time.Second)
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.Len(), 1; got != want {
+		t.Errorf("Len() after Clean = %v, want %v", got, want)
+	}
+	if got := cached(a, "a", "b"); !got["a"] || got["b"] {
+		t.Errorf("cached = %v, want b cleaned as idle", got)
+	}
+	clock.advance(time.Minute)
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Len(); got != 0 {
+		t.Errorf("Len() after second Clean = %v, want 0", got)
+	}
+}
+
+// heapInUse returns the bytes of live heap objects after a collection.
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func TestMemoryCacheCompaction(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fills a large cache")
+	}
+	ctx := context.Background()
+	a := NewMemoryCache(WithCompaction(0.5))
+	const n = 200000
+	for i := 0; i < n; i++ {
+		a.SetItem(ctx, fmt.Sprintf("purge/%d", i), Item{
+			Value:   []byte("v"),
+			Expires: time.Now().Add(time.Hour),
+			Meta:    map[string]string{TagMeta: fmt.Sprintf("tag%d", i%1000)},
+		})
+	}
+	a.Set(ctx, "keep", []byte("v"), time.Hour)
+	if err := a.DeletePrefix(ctx, "purge/"); err != nil {
+		t.Fatal(err)
+	}
+	before := heapInUse()
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after := heapInUse()
+	// The buckets of 200k keys take several megabytes; a rebuilt cache of
+	// one key takes almost nothing.
+	if before < after+1<<20 {
+		t.Errorf("heap after Clean = %v bytes, before %v; want at least 1MiB reclaimed", after, before)
+	}
+	if got := cached(a, "keep"); !got["keep"] {
+		t.Errorf("keep lost by compaction")
+	}
+	if got, want := len(a.tags), 0; got != want {
+		t.Errorf("len(tags) = %v, want %v", got, want)
+	}
+	if got, want := cap(a.ttl), 1; got != want {
+		t.Errorf("cap(ttl) = %v, want %v", got, want)
+	}
+	runtime.KeepAlive(a)
+}
+
+// BenchmarkMemoryCacheClean cleans a few expired items out of caches of
+// growing size: with the ttl heap, the time does not grow with the size.
+func BenchmarkMemoryCacheClean(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range []int{1000, 1000000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			clock := newFakeClock()
+			a := NewMemoryCache(WithClock(clock))
+			value := []byte("v")
+			for i := 0; i < n; i++ {
+				a.Set(ctx, fmt.Sprint("live/", i), value, 100*365*24*time.Hour)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 10; j++ {
+					a.Set(ctx, fmt.Sprint("expired/", j), value, time.Second)
+				}
+				clock.advance(2 * time.Second)
+				b.StartTimer()
+				if err := a.Clean(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if got := a.Len(); got != n {
+				b.Fatalf("Len() = %v, want %v", got, n)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheExportImportJSON(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	a := NewMemoryCache(WithClock(clock))
+	a.SetItem(ctx, "k", Item{
+		Value:   []byte("v"),
+		Expires: clock.Now().Add(time.Hour),
+		Meta:    map[string]string{TagMeta: "t"},
+	})
+	stored := clock.Now()
+	var buf bytes.Buffer
+	if err := a.ExportJSON(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	b := NewMemoryCache(WithClock(clock))
+	if err := b.ImportJSON(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	item, err := b.GetItem(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item.Value) != "v" || item.Meta[TagMeta] != "t" || !item.Expires.Equal(stored.Add(time.Hour)) {
+		t.Errorf("imported item = %+v", item)
+	}
+	if !item.Stored.Equal(stored) {
+		t.Errorf("imported Stored = %v, want %v as exported", item.Stored, stored)
+	}
+}
@@ -0,0 +1,72 @@
+package aecache
+
+import (
+	"sync"
+	"time"
+)
+
+// A Namespaced represents caches created lazily per namespace, e.g. per
+// tenant, and reused: For returns the same cache for a namespace, so the
+// wrappers of a namespace are not built again on each request.
+type Namespaced struct {
+	clock  Clock
+	create func(namespace string) Cache
+	m      sync.Mutex // protects caches
+	caches map[string]*namespacedCache
+}
+
+// A namespacedCache represents the cache of a namespace.
+type namespacedCache struct {
+	cache Cache
+	used  time.Time // last returned by For
+}
+
+// NewNamespaced creates a new Namespaced creating the cache of a namespace
+// with create, e.g. WithPrefix on shared backends.
+// It supports the WithClock option.
+func NewNamespaced(create func(namespace string) Cache, opts ...Option) *Namespaced {
+	o := newOptions(opts...)
+	return &Namespaced{
+		clock:  o.clock,
+		create: create,
+		caches: make(map[string]*namespacedCache),
+	}
+}
+
+// For returns the cache of a namespace, creating it on first use.
+// It is safe for concurrent use, a namespace is created once.
+func (a *Namespaced) For(namespace string) Cache {
+	a.m.Lock()
+	defer a.m.Unlock()
+	c, ok := a.caches[namespace]
+	if !ok {
+		c = &namespacedCache{cache: a.create(namespace)}
+		a.caches[namespace] = c
+	}
+	c.used = a.clock.Now()
+	return c.cache
+}
+
+// EvictIdle forgets the caches of namespaces not used for idle, so they are
+// created again on next use. Their items are left in the backends.
+// It returns the number of namespaces evicted.
+func (a *Namespaced) EvictIdle(idle time.Duration) int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	var n int
+	for namespace, c := range a.caches {
+		if now.Sub(c.used) > idle {
+			delete(a.caches, namespace)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of namespaces with a cache.
+func (a *Namespaced) Len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return len(a.caches)
+}
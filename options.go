@@ -0,0 +1,424 @@
+package aecache
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// An Option configures a cache layer.
+type Option func(*options)
+
+// options holds the configuration of a cache layer.
+type options struct {
+	clock          Clock
+	maxBytes       int
+	onEvict        func(ctx context.Context, key string, item Item, reason EvictReason)
+	workers        int
+	maxConcurrent  int
+	layerMaxTTLs   []time.Duration
+	kind           string
+	cleanDelay     time.Duration
+	cleanMaxKeys   int
+	readRepair     bool
+	tags           bool
+	refillBatch    int
+	refillDelay    time.Duration
+	layerMaxSizes  []int
+	version        byte
+	versioned      bool
+	hotThreshold   uint64
+	onEvictHot     func(ctx context.Context, key string)
+	maxTTL         time.Duration
+	reconnectAfter int
+	logger         *log.Logger
+	consistency    ConsistencyMode
+	checksum       bool
+	quorum         int
+	maxIdle        time.Duration
+	maxBackground  int
+	onFailedWrite  func(ctx context.Context, w FailedWrite)
+	itemCodec      Codec
+	bestEffort     int
+	opTimeout      time.Duration
+	promoter       Promoter
+	serveStale     time.Duration
+	compact        float64
+	validateKeys   bool
+	maxKeyLen      int
+	newPolicy      func() EvictionPolicy
+	syncMap        bool
+}
+
+// newOptions creates options with defaults, then applies opts in order.
+func newOptions(opts ...Option) *options {
+	o := &options{
+		clock:         realClock{},
+		kind:          "CacheItem",
+		maxBackground: defaultMaxBackground,
+		opTimeout:     defaultOpTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithClock sets the clock used to compute and check expirations.
+// It defaults to the system time; tests can inject a fake to control expiry.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithMaxBytes sets a budget on the summed length of values held in memory.
+// Items are evicted to stay under it and a value larger than the whole
+// budget is rejected with ErrTooBig. It defaults to 0, meaning unbounded.
+func WithMaxBytes(n int) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithOnEvict sets a callback invoked when an item is removed from the cache
+// because it expired, to make room for others or was deleted.
+// It runs outside of the cache lock so it may call back into the cache.
+// It is given the context of the operation that removed the item, from which
+// RequestID can tell which request caused it.
+func WithOnEvict(f func(ctx context.Context, key string, item Item, reason EvictReason)) Option {
+	return func(o *options) {
+		o.onEvict = f
+	}
+}
+
+// WithWorkers makes a combined cache write to its layers concurrently in Set,
+// with at most n writes in flight. All layers are attempted and their errors
+// combined. It defaults to 0, meaning sequential writes, fastest to slowest.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// defaultMaxBackground is the default of WithMaxBackground.
+const defaultMaxBackground = 64
+
+// WithMaxBackground limits the background refreshes of a combined cache in
+// flight, see GetRefreshing, so a burst of gets near expiration does not
+// spawn a goroutine and a load each. Refreshes beyond are skipped, the items
+// being still valid. It defaults to 64, and values below 1 are taken as 1.
+func WithMaxBackground(n int) Option {
+	if n < 1 {
+		n = 1
+	}
+	return func(o *options) {
+		o.maxBackground = n
+	}
+}
+
+// WithOnFailedWrite sets a callback invoked when a write in the background of
+// a combined cache fails, a refill batched with WithRefillBatch or a refresh
+// of GetRefreshing, so applications can retry, log or alert. It runs in the
+// goroutine which wrote, so it should not block.
+func WithOnFailedWrite(f func(ctx context.Context, w FailedWrite)) Option {
+	return func(o *options) {
+		o.onFailedWrite = f
+	}
+}
+
+// WithBestEffortWrites makes Set and SetItem of a combined cache attempt all
+// layers rather than stop at the first error, and succeed if the required
+// fastest layers succeeded, e.g. 1 so the memory layer stays populated while
+// the datastore is down. Errors of the other layers are logged, see
+// WithLogger. It defaults to 0, meaning writes fail on any error.
+func WithBestEffortWrites(required int) Option {
+	return func(o *options) {
+		o.bestEffort = required
+	}
+}
+
+// WithMaxConcurrent limits the datastore layer to n operations in flight.
+// Further operations wait for a slot, or for their context to be done. A
+// Clean takes a slot for its query and for each batch of deletes, not while
+// waiting between batches, see WithCleanDelay. It defaults to 0, meaning no
+// limit.
+func WithMaxConcurrent(n int) Option {
+	return func(o *options) {
+		o.maxConcurrent = n
+	}
+}
+
+// WithLayerMaxSizes sets the largest value each layer of a combined cache
+// holds, fastest to slowest, 0 meaning no limit. Bigger values skip the layer,
+// where a previous value of the key is deleted, and are not refilled in it.
+// For instance, huge values cached rarely can skip memory so they do not
+// evict many small hot items.
+func WithLayerMaxSizes(sizes ...int) Option {
+	return func(o *options) {
+		o.layerMaxSizes = sizes
+	}
+}
+
+// WithMaxTTL caps the expiration of all items written to a combined cache,
+// silently, as a guardrail against items cached for weeks by mistake.
+// It applies on top of WithLayerMaxTTLs. It defaults to 0, meaning no cap.
+func WithMaxTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.maxTTL = d
+	}
+}
+
+// WithLayerMaxTTLs caps the expiration of items in each layer of a combined
+// cache, fastest to slowest, 0 meaning no cap. For instance, hot items can
+// live briefly in memory, to bound staleness within an instance, but longer
+// in the datastore, shared across instances. Refills from a slower layer are
+// capped as well.
+func WithLayerMaxTTLs(ttls ...time.Duration) Option {
+	return func(o *options) {
+		o.layerMaxTTLs = ttls
+	}
+}
+
+// WithReconnectAfter makes the datastore layer reconnect, see Reconnect, once
+// n operations failed with connection errors, that is gRPC Unavailable, or
+// Internal or Unknown from the transport, and not a canceled context. Errors
+// are counted since the last connection, only for operations started on it.
+// It defaults to 0, meaning never.
+func WithReconnectAfter(n int) Option {
+	return func(o *options) {
+		o.reconnectAfter = n
+	}
+}
+
+// WithLogger sets a logger for what the caches cannot return to a caller:
+// failures of background refills and refreshes of a combined cache and of
+// StaleWhileRevalidate, reconnects of the datastore layer and evictions from
+// memory, each with its key or layer, and layers disabled by TryLayer. It
+// defaults to nil, meaning nothing is logged. It takes a *log.Logger rather
+// than a *slog.Logger as the module supports Go 1.12, which predates
+// log/slog.
+func WithLogger(l *log.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithChecksum makes the datastore and memcache layers store a CRC-32C
+// checksum of values, verified on read: a corrupt item is deleted and missed
+// rather than returned. Items stored with a checksum are verified even
+// without the option.
+func WithChecksum() Option {
+	return func(o *options) {
+		o.checksum = true
+	}
+}
+
+// WithQuorum makes writes to a replicated cache succeed once they succeed in
+// n replicas, so a replica down does not fail writes. Reads may then miss in
+// that replica until it is written again. It defaults to all replicas.
+func WithQuorum(n int) Option {
+	return func(o *options) {
+		o.quorum = n
+	}
+}
+
+// WithMaxIdle makes the memory layer expire items not read for d, even if
+// their expiration is later, e.g. to drop inactive sessions early. Reads
+// with GetItem count as an access, Peek does not.
+// It defaults to 0, meaning items expire only at their expiration.
+func WithMaxIdle(d time.Duration) Option {
+	return func(o *options) {
+		o.maxIdle = d
+	}
+}
+
+// WithKeyValidation makes the datastore and memcache layers check keys with
+// ValidateKey before calling their backend, so an invalid key fails early
+// with ErrInvalidKey rather than in the client library. A maxLen of 0 uses
+// the limit of the backend, 1500 bytes for datastore and 250 for memcache.
+// It is off by default: the datastore rejects invalid keys itself, and
+// memcache replaces them with their hash.
+func WithKeyValidation(maxLen int) Option {
+	return func(o *options) {
+		o.validateKeys = true
+		o.maxKeyLen = maxLen
+	}
+}
+
+// WithEvictionPolicy sets how the memory layer chooses items to evict to stay
+// under WithMaxBytes, e.g. NewLRUPolicy. The function is called once per
+// layer, or per shard of a ShardedMemoryCache, as a policy cannot be shared.
+// It defaults to evicting the soonest to expire, then least recently used.
+func WithEvictionPolicy(newPolicy func() EvictionPolicy) Option {
+	return func(o *options) {
+		o.newPolicy = newPolicy
+	}
+}
+
+// WithCompaction makes Clean of the memory layer reallocate its map of items,
+// with its tag index and expiration heap, when the items left are fewer than
+// ratio times the most it held since, as Go maps do not shrink when keys are
+// deleted. Copying the items costs a pause under the lock, so it is off by
+// default, with ratio 0.
+func WithCompaction(ratio float64) Option {
+	return func(o *options) {
+		o.compact = ratio
+	}
+}
+
+// WithItemCodec sets the codec of items in the memcache layer, e.g.
+// JSONCodec, or RawItemCodec for values already encoded, which saves the
+// encoding of the whole item on the hot path but drops Meta and Stored, see
+// RawItemCodec. Items of another codec fail to decode, so flush memcached
+// when changing it. It defaults to EncodeItem.
+func WithItemCodec(c Codec) Option {
+	return func(o *options) {
+		o.itemCodec = c
+	}
+}
+
+// defaultOpTimeout is the default of WithOpTimeout.
+const defaultOpTimeout = 30 * time.Second
+
+// WithOpTimeout sets the timeout of operations of the datastore layer given a
+// context without deadline, e.g. context.Background() in a cron job, so they
+// do not hang if the network stalls. A deadline of the context is respected.
+// Clean applies it to each call rather than the whole clean. It defaults to
+// 30 seconds, 0 disables it.
+func WithOpTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.opTimeout = d
+	}
+}
+
+// WithKind sets the kind of the entities of the datastore layer, so caches
+// sharing a project can be isolated, e.g. "SessionCache" and "FragmentCache".
+// It defaults to "CacheItem".
+func WithKind(kind string) Option {
+	return func(o *options) {
+		o.kind = kind
+	}
+}
+
+// WithCleanDelay makes Clean of the datastore layer wait between batches of
+// 500 deletes, to avoid spikes of writes: a delay of a second caps it to 500
+// deletes per second. Waits are interrupted when the context is done.
+// It defaults to 0, meaning no delay.
+func WithCleanDelay(d time.Duration) Option {
+	return func(o *options) {
+		o.cleanDelay = d
+	}
+}
+
+// WithCleanMaxKeys bounds the number of expired items deleted by each Clean
+// of the datastore layer, so a run does bounded work, e.g. from a frequent
+// cron. It defaults to 0, meaning no bound.
+func WithCleanMaxKeys(n int) Option {
+	return func(o *options) {
+		o.cleanMaxKeys = n
+	}
+}
+
+// WithConsistency sets which layers a combined cache reads to get an item,
+// see ConsistencyMode. Faster layers are refilled with the item returned.
+// It defaults to FirstHit. WithReadRepair only applies to FirstHit.
+func WithConsistency(mode ConsistencyMode) Option {
+	return func(o *options) {
+		o.consistency = mode
+	}
+}
+
+// WithPromoter sets a policy deciding whether a combined cache refills its
+// faster layers with an item found in a slower one, e.g. FrequencyPromoter.
+// It applies on top of WithLayerMaxSizes. It defaults to refilling all.
+func WithPromoter(p Promoter) Option {
+	return func(o *options) {
+		o.promoter = p
+	}
+}
+
+// WithServeStale makes a read-through cache keep items for d past their
+// expiration and, when loading an expired key fails, return its last known
+// item rather than the error, to degrade gracefully during outages of the
+// source of truth. It defaults to 0, meaning load errors are returned.
+//
+// WARNING: items are written to the underlying cache with their expiration
+// pushed back by d, the real one kept in the "aecache-fresh" Meta. A reader of
+// that cache not going through the read-through cache, in this process or
+// another one sharing it, sees them as valid for d past their expiration. Do
+// not share the underlying cache with such readers.
+func WithServeStale(d time.Duration) Option {
+	return func(o *options) {
+		o.serveStale = d
+	}
+}
+
+// WithReadRepair makes a combined cache check, on a hit in a faster layer,
+// the item in the slowest layer, which is authoritative. If the faster item
+// is stale, that is its value differs or, in layers without a maximum
+// expiration, it expires sooner, the slowest item is returned and faster
+// layers are refreshed. Every hit then costs a read of the slowest layer, so
+// it is off by default.
+func WithReadRepair() Option {
+	return func(o *options) {
+		o.readRepair = true
+	}
+}
+
+// WithTags makes the datastore layer store the tag of items, their TagMeta,
+// in an indexed property so DeleteByTag can delete all items of a tag with a
+// query. Indexing costs a few more writes per item so it defaults to off.
+func WithTags() Option {
+	return func(o *options) {
+		o.tags = true
+	}
+}
+
+// WithRefillBatch makes a combined cache refill its faster layers in the
+// background, in batches: refills are queued and set when maxBatch are
+// pending or after maxDelay, in one call to layers which are a MultiSetter.
+// Under a burst of misses in the faster layers, it saves lock contention and
+// round trips. Writes and deletes of a key drop its queued refills, so these
+// do not bring back an older item. Refill errors are logged, see WithLogger.
+// It defaults to synchronous refills.
+func WithRefillBatch(maxBatch int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.refillBatch = maxBatch
+		o.refillDelay = maxDelay
+	}
+}
+
+// WithSchemaVersion makes a CodecCache prefix encoded values with a version
+// byte, checked on read: values of another version are misses, so they are
+// populated again. Bump it when the cached type changes so values encoded
+// by a previous deploy are not decoded into garbage.
+func WithSchemaVersion(version byte) Option {
+	return func(o *options) {
+		o.version = version
+		o.versioned = true
+	}
+}
+
+// WithOnEvictHot sets a callback invoked when an item is evicted to make room
+// for others although it was read at least threshold times, see Hits. It can
+// prefetch the item back from a slower layer so hot items stay resident under
+// capacity pressure, e.g. with CombinedCache.Prefetch in a goroutine. The
+// prefetched item starts with no hits, so it is not prefetched again unless
+// it is still read.
+func WithOnEvictHot(threshold uint64, f func(ctx context.Context, key string)) Option {
+	return func(o *options) {
+		o.hotThreshold = threshold
+		o.onEvictHot = f
+	}
+}
+
+// WithSyncMap makes NewMemoryLayer create a SyncMapCache rather than a
+// MemoryCache, for read-heavy workloads: reads do not take a lock, writes
+// are serialized. The options of MemoryCache which SyncMapCache lacks, like
+// WithMaxBytes, are then ignored.
+func WithSyncMap() Option {
+	return func(o *options) {
+		o.syncMap = true
+	}
+}
@@ -0,0 +1,120 @@
+package aecache
+
+import "container/list"
+
+// An EvictionPolicy chooses which item a memory layer evicts to stay under
+// its byte budget. The layer records accesses and writes of keys, and keys
+// removed for any reason, then asks for a victim while over budget.
+// Methods are called under the lock of the layer, so they need not be safe
+// for concurrent use, but a policy must not be shared by several layers.
+type EvictionPolicy interface {
+	// RecordAccess records a get of a key.
+	RecordAccess(key string)
+	// RecordWrite records a key set to a value of size bytes.
+	RecordWrite(key string, size int)
+	// RecordRemove records a key removed, to forget it.
+	RecordRemove(key string)
+	// Victim returns the key to evict next, or false if it knows none.
+	Victim() (key string, ok bool)
+}
+
+// A listPolicy evicts the key at the back of a list of keys, moved to the
+// front when written and, if recent, accessed.
+type listPolicy struct {
+	recent bool // move keys to the front on access
+	order  *list.List
+	keys   map[string]*list.Element
+}
+
+// NewLRUPolicy returns a policy evicting the least recently used key, set or
+// got, regardless of expiration.
+func NewLRUPolicy() EvictionPolicy {
+	return &listPolicy{recent: true, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// NewFIFOPolicy returns a policy evicting the key set first, regardless of
+// accesses and expiration.
+func NewFIFOPolicy() EvictionPolicy {
+	return &listPolicy{order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// RecordAccess moves a key to the front if recency counts.
+func (p *listPolicy) RecordAccess(key string) {
+	if e, ok := p.keys[key]; ok && p.recent {
+		p.order.MoveToFront(e)
+	}
+}
+
+// RecordWrite moves a key to the front.
+func (p *listPolicy) RecordWrite(key string, size int) {
+	if e, ok := p.keys[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.keys[key] = p.order.PushFront(key)
+}
+
+// RecordRemove forgets a key.
+func (p *listPolicy) RecordRemove(key string) {
+	if e, ok := p.keys[key]; ok {
+		p.order.Remove(e)
+		delete(p.keys, key)
+	}
+}
+
+// Victim returns the key at the back.
+func (p *listPolicy) Victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// An lfuPolicy evicts the key least frequently got since set.
+type lfuPolicy struct {
+	tick uint64 // incremented on each write, to break ties oldest first
+	keys map[string]*lfuEntry
+}
+
+// An lfuEntry represents the accesses of a key.
+type lfuEntry struct {
+	hits    uint64
+	written uint64
+}
+
+// NewLFUPolicy returns a policy evicting the key least frequently got since
+// set, the oldest set among ties. Victim scans all keys.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{keys: make(map[string]*lfuEntry)}
+}
+
+// RecordAccess counts a get of a key.
+func (p *lfuPolicy) RecordAccess(key string) {
+	if e, ok := p.keys[key]; ok {
+		e.hits++
+	}
+}
+
+// RecordWrite resets the count of a key.
+func (p *lfuPolicy) RecordWrite(key string, size int) {
+	p.tick++
+	p.keys[key] = &lfuEntry{written: p.tick}
+}
+
+// RecordRemove forgets a key.
+func (p *lfuPolicy) RecordRemove(key string) {
+	delete(p.keys, key)
+}
+
+// Victim returns the key with the fewest gets, the oldest set among ties.
+func (p *lfuPolicy) Victim() (string, bool) {
+	var key string
+	var victim *lfuEntry
+	for k, e := range p.keys {
+		if victim == nil || e.hits < victim.hits || e.hits == victim.hits && e.written < victim.written {
+			key, victim = k, e
+		}
+	}
+	return key, victim != nil
+}
@@ -0,0 +1,105 @@
+package aecache
+
+import (
+	"context"
+	"time"
+)
+
+// A prefixedCache represents a cache where keys are namespaced by a prefix.
+type prefixedCache struct {
+	cache  Cache
+	prefix string // including separator
+}
+
+// WithPrefix wraps a cache so every key is prefixed with prefix and ":",
+// letting several logical caches share a backend without collisions.
+// It composes: WithPrefix(WithPrefix(c, "a"), "b") prefixes keys with "a:b:".
+// DeletePrefix is scoped to the namespace, so DeletePrefix(ctx, "") flushes
+// just it. Clean is not scoped and cleans the whole underlying cache, nor is
+// DeleteByTag, which deletes the items of a tag in all namespaces.
+func WithPrefix(inner Cache, prefix string) Cache {
+	return &prefixedCache{cache: inner, prefix: prefix + ":"}
+}
+
+// Set sets a key to a value with an expiration.
+func (a *prefixedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return a.cache.Set(ctx, a.prefix+key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *prefixedCache) SetItem(ctx context.Context, key string, item Item) error {
+	return a.cache.SetItem(ctx, a.prefix+key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *prefixedCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return a.cache.Add(ctx, a.prefix+key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *prefixedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return a.cache.Get(ctx, a.prefix+key)
+}
+
+// GetItem gets the item for a key.
+func (a *prefixedCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.cache.GetItem(ctx, a.prefix+key)
+}
+
+// Peek gets the item for a key, without modifying the underlying cache if it
+// is a Peeker.
+func (a *prefixedCache) Peek(ctx context.Context, key string) (Item, error) {
+	return peek(ctx, a.cache, a.prefix+key)
+}
+
+// Clean deletes expired items.
+func (a *prefixedCache) Clean(ctx context.Context) error {
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (a *prefixedCache) Delete(ctx context.Context, key string) error {
+	return a.cache.Delete(ctx, a.prefix+key)
+}
+
+// Invalidate removes a key and anything the underlying cache remembers
+// about it if it is an Invalidator.
+func (a *prefixedCache) Invalidate(ctx context.Context, key string) error {
+	return invalidate(ctx, a.cache, a.prefix+key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *prefixedCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	return deleteIf(ctx, a.cache, a.prefix+key, expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *prefixedCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+func (a *prefixedCache) DeleteMulti(ctx context.Context, keys []string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = a.prefix + key
+	}
+	return a.cache.DeleteMulti(ctx, prefixed)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *prefixedCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.cache.DeletePrefix(ctx, a.prefix+prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag, in all namespaces.
+func (a *prefixedCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *prefixedCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
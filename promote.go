@@ -0,0 +1,90 @@
+package aecache
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// A Promoter decides whether a CombinedCache refills its faster layers with
+// an item found in a slower layer, e.g. so a large or rarely read value does
+// not evict many small hot items from memory.
+type Promoter interface {
+	// Promote tells whether to refill the faster layers with the item of a
+	// key. It is called on each get found in a slower layer.
+	Promote(key string, item Item) bool
+}
+
+// A PromoterFunc is a function used as a Promoter.
+type PromoterFunc func(key string, item Item) bool
+
+// Promote calls f(key, item).
+func (f PromoterFunc) Promote(key string, item Item) bool {
+	return f(key, item)
+}
+
+// sketchDepth is the number of rows of the count-min sketch of a
+// FrequencyPromoter, each indexed by its own hash of the key.
+const sketchDepth = 4
+
+// A frequencyPromoter represents a TinyLFU-like admission filter: it
+// estimates how often keys are read with a count-min sketch of small
+// counters, halved periodically so the estimate favors recent reads.
+type frequencyPromoter struct {
+	minHits int
+	maxSize int
+	m       sync.Mutex // protects below
+	rows    [sketchDepth][]uint8
+	adds    int // since the last halving
+}
+
+// FrequencyPromoter returns a Promoter which promotes items of at most
+// maxSize bytes, 0 for any size, whose key was read from slower layers at
+// least minHits times recently. Reads are estimated in a fixed memory of
+// width bytes per row, 4 rows, so keys may be overestimated on collisions;
+// counters are halved every 10 times width reads to forget old reads.
+func FrequencyPromoter(minHits, maxSize, width int) Promoter {
+	if width < 1 {
+		width = 1
+	}
+	p := &frequencyPromoter{minHits: minHits, maxSize: maxSize}
+	for i := range p.rows {
+		p.rows[i] = make([]uint8, width)
+	}
+	return p
+}
+
+// Promote counts a read of the key and tells whether it is frequent enough
+// and the item small enough.
+func (p *frequencyPromoter) Promote(key string, item Item) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// Derive the index of each row by double hashing.
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	p.m.Lock()
+	defer p.m.Unlock()
+	estimate := -1
+	for i := range p.rows {
+		row := p.rows[i]
+		j := (h1 + uint32(i)*h2) % uint32(len(row))
+		if row[j] < 255 {
+			row[j]++
+		}
+		if estimate < 0 || int(row[j]) < estimate {
+			estimate = int(row[j])
+		}
+	}
+	p.adds++
+	if p.adds >= 10*len(p.rows[0]) {
+		for _, row := range p.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+		p.adds = 0
+	}
+	if p.maxSize > 0 && len(item.Value) > p.maxSize {
+		return false
+	}
+	return estimate >= p.minHits
+}
@@ -0,0 +1,139 @@
+package aecache
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A refiller batches refills of the faster layers of a CombinedCache and
+// flushes them when the batch is full or after a delay, whichever first.
+type refiller struct {
+	executed uint64 // atomic, first for alignment
+	caches   []Cache
+	maxBatch int
+	maxDelay time.Duration
+	logger   *log.Logger
+	onFailed func(ctx context.Context, w FailedWrite)
+	m        sync.Mutex        // protects below
+	pending  []map[string]Item // by layer, then key
+	n        int               // number of pending items
+	timer    *time.Timer       // flushes after maxDelay, nil if none pending
+}
+
+// newRefiller creates a new refiller for the layers of a CombinedCache.
+func newRefiller(caches []Cache, maxBatch int, maxDelay time.Duration, logger *log.Logger, onFailed func(ctx context.Context, w FailedWrite)) *refiller {
+	return &refiller{
+		caches:   caches,
+		maxBatch: maxBatch,
+		maxDelay: maxDelay,
+		logger:   logger,
+		onFailed: onFailed,
+		pending:  make([]map[string]Item, len(caches)),
+	}
+}
+
+// add queues a refill of a layer. A full batch is flushed by the caller, so
+// pending refills stay bounded.
+func (r *refiller) add(layer int, key string, item Item) {
+	r.m.Lock()
+	if r.pending[layer] == nil {
+		r.pending[layer] = make(map[string]Item)
+	}
+	if _, ok := r.pending[layer][key]; !ok {
+		r.n++
+	}
+	r.pending[layer][key] = item
+	if r.n < r.maxBatch {
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.maxDelay, r.flush)
+		}
+		r.m.Unlock()
+		return
+	}
+	pending := r.take()
+	r.m.Unlock()
+	r.set(pending)
+}
+
+// flush sets the pending refills.
+func (r *refiller) flush() {
+	r.m.Lock()
+	pending := r.take()
+	r.m.Unlock()
+	r.set(pending)
+}
+
+// forget drops the pending refills of keys matching f, in all layers, so a
+// refill queued before a write or a delete of the key does not overwrite it.
+func (r *refiller) forget(f func(key string, item Item) bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, items := range r.pending {
+		for key, item := range items {
+			if f(key, item) {
+				delete(items, key)
+				r.n--
+			}
+		}
+	}
+}
+
+// depth returns the number of pending refills.
+func (r *refiller) depth() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.n
+}
+
+// take returns the pending refills and resets them.
+// The lock must be held.
+func (r *refiller) take() []map[string]Item {
+	pending := r.pending
+	r.pending = make([]map[string]Item, len(r.caches))
+	r.n = 0
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	return pending
+}
+
+// set sets refills in their layer, in one call for a MultiSetter.
+// Refills are best-effort: errors are logged, if a logger is set, and
+// reported as failed writes, as the caller is gone. A MultiSetter failing
+// fails all its refills.
+func (r *refiller) set(pending []map[string]Item) {
+	ctx := withRefill(context.Background())
+	for i, items := range pending {
+		if len(items) == 0 {
+			continue
+		}
+		c := r.caches[i]
+		atomic.AddUint64(&r.executed, uint64(len(items)))
+		if m, ok := c.(MultiSetter); ok {
+			if err := m.SetItemMulti(ctx, items); err != nil {
+				logf(r.logger, "aecache: refilling %v: %v", LayerName(c), err)
+				for key, item := range items {
+					r.failed(ctx, FailedWrite{Key: key, Item: item, Layer: c, Err: err})
+				}
+			}
+			continue
+		}
+		for key, item := range items {
+			if err := c.SetItem(ctx, key, item); err != nil {
+				logf(r.logger, "aecache: refilling %v: %v", LayerName(c), err)
+				r.failed(ctx, FailedWrite{Key: key, Item: item, Layer: c, Err: err})
+			}
+		}
+	}
+}
+
+// failed reports a failed write, if a callback is set.
+func (r *refiller) failed(ctx context.Context, w FailedWrite) {
+	if r.onFailed != nil {
+		r.onFailed(ctx, w)
+	}
+}
@@ -0,0 +1,219 @@
+package aecache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A ReplicatedCache represents equivalent caches, e.g. datastores in two
+// regions, for high availability rather than tiering as a CombinedCache:
+// writes go to all replicas and reads to the first replica which has the
+// item, in order, so the nearest replica is best listed first.
+type ReplicatedCache struct {
+	replicas []Cache // in order of preference for reads
+	quorum   int     // successful writes for a write to succeed
+}
+
+// NewReplicatedCache creates a new ReplicatedCache from replicas, in order of
+// preference for reads.
+// It supports the WithQuorum option. Writes succeed if they succeed in all
+// replicas by default.
+func NewReplicatedCache(replicas []Cache, opts ...Option) *ReplicatedCache {
+	o := newOptions(opts...)
+	quorum := o.quorum
+	if quorum <= 0 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	return &ReplicatedCache{replicas: replicas, quorum: quorum}
+}
+
+// Name returns the name of the layer.
+func (a *ReplicatedCache) Name() string {
+	return "replicated"
+}
+
+// write runs f on all replicas concurrently. It succeeds if f succeeds in a
+// quorum of replicas, otherwise it combines their errors by layer name.
+func (a *ReplicatedCache) write(f func(c Cache) error) error {
+	var wg sync.WaitGroup
+	var m sync.Mutex // protects errs
+	var errs []error
+	for _, e := range a.replicas {
+		wg.Add(1)
+		go func(e Cache) {
+			defer wg.Done()
+			if err := f(e); err != nil {
+				m.Lock()
+				errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+				m.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+	if len(a.replicas)-len(errs) >= a.quorum {
+		return nil
+	}
+	return combineErrors(errs)
+}
+
+// read runs f on replicas in order until one has the item. Replicas which
+// fail are skipped; if none has the item, it is a miss unless all failed.
+func (a *ReplicatedCache) read(f func(c Cache) (Item, error)) (Item, error) {
+	var errs []error
+	for _, e := range a.replicas {
+		item, err := f(e)
+		if err == nil {
+			return item, nil
+		}
+		if err != ErrCacheMiss {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(e), err))
+		}
+	}
+	if len(errs) == len(a.replicas) {
+		return Item{}, combineErrors(errs)
+	}
+	return Item{}, ErrCacheMiss
+}
+
+// Set sets a key to a value with an expiration in all replicas.
+func (a *ReplicatedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return a.write(func(c Cache) error {
+		return c.Set(ctx, key, value, expiration)
+	})
+}
+
+// SetItem sets a key to an item in all replicas, unless it is already
+// expired.
+func (a *ReplicatedCache) SetItem(ctx context.Context, key string, item Item) error {
+	return a.write(func(c Cache) error {
+		return c.SetItem(ctx, key, item)
+	})
+}
+
+// Add sets a key to a value with an expiration in all replicas, only if the
+// key is not already set to a value not expired. It returns whether the key
+// was set in a quorum of replicas.
+func (a *ReplicatedCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	var m sync.Mutex // protects added
+	var added int
+	err := a.write(func(c Cache) error {
+		ok, err := c.Add(ctx, key, value, expiration)
+		if ok {
+			m.Lock()
+			added++
+			m.Unlock()
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return added >= a.quorum, nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *ReplicatedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key from the first replica which has it.
+func (a *ReplicatedCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.read(func(c Cache) (Item, error) {
+		return c.GetItem(ctx, key)
+	})
+}
+
+// Peek gets the item for a key from the first replica which has it, with
+// Peek for replicas which are a Peeker, GetItem otherwise.
+func (a *ReplicatedCache) Peek(ctx context.Context, key string) (Item, error) {
+	return a.read(func(c Cache) (Item, error) {
+		return peek(ctx, c, key)
+	})
+}
+
+// Clean deletes expired items in all replicas.
+func (a *ReplicatedCache) Clean(ctx context.Context) error {
+	return a.write(func(c Cache) error {
+		return c.Clean(ctx)
+	})
+}
+
+// Delete deletes a key in all replicas.
+func (a *ReplicatedCache) Delete(ctx context.Context, key string) error {
+	return a.write(func(c Cache) error {
+		return c.Delete(ctx, key)
+	})
+}
+
+// Invalidate removes a key and anything remembered about it in all
+// replicas, with Invalidate for those which are an Invalidator.
+func (a *ReplicatedCache) Invalidate(ctx context.Context, key string) error {
+	return a.write(func(c Cache) error {
+		return invalidate(ctx, c, key)
+	})
+}
+
+// DeleteIf deletes a key in all replicas, only where it is set to a value
+// not expired equal to expected. It returns whether the key was deleted in a
+// quorum of replicas.
+func (a *ReplicatedCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	var m sync.Mutex // protects deleted
+	var deleted int
+	err := a.write(func(c Cache) error {
+		ok, err := deleteIf(ctx, c, key, expected)
+		if ok {
+			m.Lock()
+			deleted++
+			m.Unlock()
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted >= a.quorum, nil
+}
+
+// canDeleteIf tells whether all replicas can delete conditionally.
+func (a *ReplicatedCache) canDeleteIf() bool {
+	for _, c := range a.replicas {
+		if !canDeleteIf(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteMulti deletes keys in all replicas.
+func (a *ReplicatedCache) DeleteMulti(ctx context.Context, keys []string) error {
+	return a.write(func(c Cache) error {
+		return c.DeleteMulti(ctx, keys)
+	})
+}
+
+// DeletePrefix deletes items whose key starts with prefix in all replicas.
+func (a *ReplicatedCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.write(func(c Cache) error {
+		return c.DeletePrefix(ctx, prefix)
+	})
+}
+
+// DeleteByTag deletes items whose TagMeta is tag in all replicas.
+func (a *ReplicatedCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.write(func(c Cache) error {
+		return c.DeleteByTag(ctx, tag)
+	})
+}
+
+// Ping checks a quorum of replicas is healthy.
+func (a *ReplicatedCache) Ping(ctx context.Context) error {
+	return a.write(func(c Cache) error {
+		return ping(ctx, c)
+	})
+}
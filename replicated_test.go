@@ -0,0 +1,70 @@
+package aecache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/StalkR/aecache"
+	"github.com/StalkR/aecache/aecachetest"
+)
+
+func TestReplicatedCacheQuorum(t *testing.T) {
+	ctx := context.Background()
+	fail := errors.New("down")
+	for _, tt := range []struct {
+		quorum int
+		ok     bool
+	}{
+		{0, false}, // all replicas by default
+		{2, true},
+		{3, false},
+	} {
+		a, b, c := aecachetest.NewFakeCache(), aecachetest.NewFakeCache(), aecachetest.NewFakeCache()
+		c.FailCall(1, fail)
+		r := aecache.NewReplicatedCache([]aecache.Cache{a, b, c}, aecache.WithQuorum(tt.quorum))
+		err := r.Set(ctx, "k", []byte("v"), time.Hour)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("quorum %d: Set with a replica down = %v; want success %v", tt.quorum, err, tt.ok)
+		}
+	}
+}
+
+func TestReplicatedCacheRead(t *testing.T) {
+	ctx := context.Background()
+	clock := aecachetest.NewFakeClock()
+	near := aecachetest.NewFakeCache(aecache.WithClock(clock))
+	far := aecachetest.NewFakeCache(aecache.WithClock(clock))
+	r := aecache.NewReplicatedCache([]aecache.Cache{near, far})
+	near.Set(ctx, "k", []byte("near"), time.Minute)
+	far.Set(ctx, "k", []byte("far"), time.Hour)
+	if value, _, err := r.Get(ctx, "k"); err != nil || string(value) != "near" {
+		t.Errorf("Get() = %q, %v; want near", value, err)
+	}
+	// Once expired in the nearest replica, the item is read from the next.
+	clock.Advance(2 * time.Minute)
+	if value, _, err := r.Get(ctx, "k"); err != nil || string(value) != "far" {
+		t.Errorf("Get() after expiry in near = %q, %v; want far", value, err)
+	}
+	// A replica down is skipped.
+	near.FailCall(len(near.Calls())+1, errors.New("down"))
+	if value, _, err := r.Get(ctx, "k"); err != nil || string(value) != "far" {
+		t.Errorf("Get() with near down = %q, %v; want far", value, err)
+	}
+	clock.Advance(time.Hour)
+	if _, _, err := r.Get(ctx, "k"); err != aecache.ErrCacheMiss {
+		t.Errorf("Get() after expiry in all = %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestReplicatedCacheAllDown(t *testing.T) {
+	ctx := context.Background()
+	a, b := aecachetest.NewFakeCache(), aecachetest.NewFakeCache()
+	a.FailCall(1, errors.New("down"))
+	b.FailCall(1, errors.New("down"))
+	r := aecache.NewReplicatedCache([]aecache.Cache{a, b})
+	if _, err := r.GetItem(ctx, "k"); err == nil || err == aecache.ErrCacheMiss {
+		t.Errorf("GetItem() with all replicas down = %v; want their errors", err)
+	}
+}
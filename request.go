@@ -0,0 +1,168 @@
+package aecache
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// requestCacheKey is the context key of the items of a RequestCache.
+var requestCacheKey interface{} = contextKey("request-cache")
+
+// requestItems are the items of a RequestCache for a request.
+type requestItems map[string]Item
+
+// WithRequestCache returns a context carrying an empty map of items for a
+// RequestCache, scoped to a request and discarded with it.
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey, requestItems{})
+}
+
+// A RequestCache represents a cache scoped to a request: items are stored in
+// a map carried by the context, see WithRequestCache, and discarded with it.
+// It is meant as the fastest layer of a CombinedCache, when a request reads
+// the same keys multiple times. Without a map in the context, it misses and
+// drops writes.
+// It has no lock, so a context must not be used concurrently with it.
+type RequestCache struct {
+	clock Clock
+}
+
+// NewRequestCache creates a new RequestCache.
+// It supports the WithClock option.
+func NewRequestCache(opts ...Option) *RequestCache {
+	o := newOptions(opts...)
+	return &RequestCache{clock: o.clock}
+}
+
+// items returns the items carried by a context, nil if none.
+func (a *RequestCache) items(ctx context.Context) requestItems {
+	items, _ := ctx.Value(requestCacheKey).(requestItems)
+	return items
+}
+
+// Set sets a key to a value with an expiration.
+func (a *RequestCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *RequestCache) SetItem(ctx context.Context, key string, item Item) error {
+	items := a.items(ctx)
+	now := a.clock.Now()
+	if items == nil || item.Expires.Before(now) {
+		return nil
+	}
+	items[key] = stamp(ctx, item, now)
+	return nil
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *RequestCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	items := a.items(ctx)
+	if items == nil || expiration <= 0 {
+		return false, nil
+	}
+	now := a.clock.Now()
+	if item, ok := items[key]; ok && !item.Expires.Before(now) {
+		return false, nil
+	}
+	items[key] = Item{Value: value, Expires: now.Add(expiration), Stored: now}
+	return true, nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *RequestCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+func (a *RequestCache) GetItem(ctx context.Context, key string) (Item, error) {
+	items := a.items(ctx)
+	item, ok := items[key]
+	if !ok {
+		return Item{}, ErrCacheMiss
+	}
+	if item.Expires.Before(a.clock.Now()) {
+		delete(items, key)
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// Peek gets the item for a key, without deleting it if expired.
+func (a *RequestCache) Peek(ctx context.Context, key string) (Item, error) {
+	item, ok := a.items(ctx)[key]
+	if !ok || item.Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// Clean deletes expired items of the request.
+func (a *RequestCache) Clean(ctx context.Context) error {
+	items := a.items(ctx)
+	now := a.clock.Now()
+	for key, item := range items {
+		if item.Expires.Before(now) {
+			delete(items, key)
+		}
+	}
+	return nil
+}
+
+// Delete deletes a key.
+func (a *RequestCache) Delete(ctx context.Context, key string) error {
+	delete(a.items(ctx), key)
+	return nil
+}
+
+// DeleteMulti deletes keys.
+func (a *RequestCache) DeleteMulti(ctx context.Context, keys []string) error {
+	items := a.items(ctx)
+	for _, key := range keys {
+		delete(items, key)
+	}
+	return nil
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *RequestCache) DeletePrefix(ctx context.Context, prefix string) error {
+	items := a.items(ctx)
+	for key := range items {
+		if strings.HasPrefix(key, prefix) {
+			delete(items, key)
+		}
+	}
+	return nil
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+// Items of a request are few, so they are scanned.
+func (a *RequestCache) DeleteByTag(ctx context.Context, tag string) error {
+	items := a.items(ctx)
+	for key, item := range items {
+		if item.Meta[TagMeta] == tag {
+			delete(items, key)
+		}
+	}
+	return nil
+}
+
+// Ping checks the cache is healthy, which it always is.
+func (a *RequestCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Name returns the name of the layer.
+func (a *RequestCache) Name() string {
+	return "request"
+}
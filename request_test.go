@@ -0,0 +1,56 @@
+package aecache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestCacheScope(t *testing.T) {
+	a := NewRequestCache()
+	ctx := WithRequestCache(context.Background())
+	a.Set(ctx, "k", []byte("v"), time.Hour)
+	if value, _, err := a.Get(ctx, "k"); err != nil || string(value) != "v" {
+		t.Errorf("Get() = %q, %v; want v", value, err)
+	}
+	// Another request has its own items.
+	if _, _, err := a.Get(WithRequestCache(context.Background()), "k"); err != ErrCacheMiss {
+		t.Errorf("Get() in another request = %v; want ErrCacheMiss", err)
+	}
+	// Without a map in the context, writes are dropped.
+	bare := context.Background()
+	if err := a.Set(bare, "k", []byte("v"), time.Hour); err != nil {
+		t.Errorf("Set() without map = %v; want nil", err)
+	}
+	if added, err := a.Add(bare, "k", []byte("v"), time.Hour); added || err != nil {
+		t.Errorf("Add() without map = %v, %v; want false, nil", added, err)
+	}
+	if _, _, err := a.Get(bare, "k"); err != ErrCacheMiss {
+		t.Errorf("Get() without map = %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestRequestCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	a := NewRequestCache(WithClock(clock))
+	ctx := WithRequestCache(context.Background())
+	a.Set(ctx, "a", []byte("a"), time.Minute)
+	a.Set(ctx, "b", []byte("b"), time.Hour)
+	clock.advance(2 * time.Minute)
+	if _, err := a.Peek(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("Peek(a) after expiry = %v; want ErrCacheMiss", err)
+	}
+	if added, err := a.Add(ctx, "a", []byte("new"), time.Minute); !added || err != nil {
+		t.Errorf("Add(a) after expiry = %v, %v; want true, nil", added, err)
+	}
+	clock.advance(2 * time.Minute)
+	if err := a.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if items := a.items(ctx); len(items) != 1 {
+		t.Errorf("items after Clean = %v; want b only", items)
+	}
+	if _, err := a.GetItem(ctx, "b"); err != nil {
+		t.Errorf("GetItem(b) = %v; want hit", err)
+	}
+}
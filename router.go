@@ -0,0 +1,162 @@
+package aecache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A Router represents a cache which routes each key to one of several
+// backends by a policy, e.g. sessions to memcache and the rest to datastore.
+type Router struct {
+	route    func(key string) Cache
+	def      Cache
+	backends []Cache // distinct backends, def first
+}
+
+// NewRouter creates a new Router, which operates on each key in the backend
+// route returns for it, or in def if it returns nil. Route must return nil,
+// def or one of backends. Operations without a key, Clean, Ping, DeletePrefix
+// and DeleteByTag, fan out to def and all backends, listed once each even if
+// repeated. The backends must be comparable, which pointers are.
+func NewRouter(route func(key string) Cache, def Cache, backends ...Cache) *Router {
+	known := []Cache{def}
+	for _, c := range backends {
+		seen := false
+		for _, e := range known {
+			if e == c {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			known = append(known, c)
+		}
+	}
+	return &Router{route: route, def: def, backends: known}
+}
+
+// backend returns the backend of a key.
+func (a *Router) backend(key string) Cache {
+	if c := a.route(key); c != nil {
+		return c
+	}
+	return a.def
+}
+
+// Set sets a key to a value with an expiration.
+func (a *Router) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return a.backend(key).Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *Router) SetItem(ctx context.Context, key string, item Item) error {
+	return a.backend(key).SetItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *Router) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return a.backend(key).Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *Router) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return a.backend(key).Get(ctx, key)
+}
+
+// GetItem gets the item for a key.
+func (a *Router) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.backend(key).GetItem(ctx, key)
+}
+
+// Peek gets the item for a key, without modifying its backend if it is a
+// Peeker.
+func (a *Router) Peek(ctx context.Context, key string) (Item, error) {
+	return peek(ctx, a.backend(key), key)
+}
+
+// Clean deletes expired items in all backends.
+// It attempts all backends and combines their errors by layer name.
+func (a *Router) Clean(ctx context.Context) error {
+	return a.each(func(c Cache) error { return c.Clean(ctx) })
+}
+
+// Delete deletes a key.
+func (a *Router) Delete(ctx context.Context, key string) error {
+	return a.backend(key).Delete(ctx, key)
+}
+
+// Invalidate removes a key and anything its backend remembers about it if it
+// is an Invalidator.
+func (a *Router) Invalidate(ctx context.Context, key string) error {
+	return invalidate(ctx, a.backend(key), key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *Router) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	return deleteIf(ctx, a.backend(key), key, expected)
+}
+
+// canDeleteIf tells whether all backends can delete conditionally.
+func (a *Router) canDeleteIf() bool {
+	for _, c := range a.backends {
+		if !canDeleteIf(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteMulti deletes keys, in one call per backend.
+func (a *Router) DeleteMulti(ctx context.Context, keys []string) error {
+	var backends []Cache
+	byBackend := make(map[Cache][]string)
+	for _, key := range keys {
+		c := a.backend(key)
+		if _, ok := byBackend[c]; !ok {
+			backends = append(backends, c)
+		}
+		byBackend[c] = append(byBackend[c], key)
+	}
+	for _, c := range backends {
+		if err := c.DeleteMulti(ctx, byBackend[c]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix deletes items whose key starts with prefix in all backends.
+// It attempts all backends and combines their errors by layer name.
+func (a *Router) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.each(func(c Cache) error { return c.DeletePrefix(ctx, prefix) })
+}
+
+// DeleteByTag deletes items whose TagMeta is tag in all backends.
+// It attempts all backends and combines their errors by layer name.
+func (a *Router) DeleteByTag(ctx context.Context, tag string) error {
+	return a.each(func(c Cache) error { return c.DeleteByTag(ctx, tag) })
+}
+
+// Ping checks all backends are healthy and combines their errors.
+func (a *Router) Ping(ctx context.Context) error {
+	return a.each(func(c Cache) error { return ping(ctx, c) })
+}
+
+// Name returns the name of the layer.
+func (a *Router) Name() string {
+	return "router"
+}
+
+// each calls f on all backends and combines their errors.
+func (a *Router) each(f func(c Cache) error) error {
+	var errs []error
+	for _, c := range a.backends {
+		if err := f(c); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", LayerName(c), err))
+		}
+	}
+	return combineErrors(errs)
+}
@@ -0,0 +1,68 @@
+package aecache_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StalkR/aecache"
+	"github.com/StalkR/aecache/aecachetest"
+)
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	clock := aecachetest.NewFakeClock()
+	sessions := aecachetest.NewFakeCache(aecache.WithClock(clock))
+	def := aecachetest.NewFakeCache(aecache.WithClock(clock))
+	r := aecache.NewRouter(func(key string) aecache.Cache {
+		if strings.HasPrefix(key, "session:") {
+			return sessions
+		}
+		return nil
+	}, def, sessions, sessions)
+	r.Set(ctx, "session:1", []byte("s"), time.Minute)
+	r.Set(ctx, "page", []byte("p"), time.Hour)
+	if _, err := sessions.GetItem(ctx, "session:1"); err != nil {
+		t.Errorf("session not in its backend: %v", err)
+	}
+	if _, err := def.GetItem(ctx, "page"); err != nil {
+		t.Errorf("page not in the default backend: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := r.GetItem(ctx, "session:1"); err != aecache.ErrCacheMiss {
+		t.Errorf("GetItem(session:1) after expiry = %v; want ErrCacheMiss", err)
+	}
+	if _, err := r.GetItem(ctx, "page"); err != nil {
+		t.Errorf("GetItem(page) = %v; want hit", err)
+	}
+}
+
+func TestRouterFanOut(t *testing.T) {
+	ctx := context.Background()
+	a, def := aecachetest.NewFakeCache(), aecachetest.NewFakeCache()
+	r := aecache.NewRouter(func(key string) aecache.Cache {
+		if strings.HasPrefix(key, "a") {
+			return a
+		}
+		return def
+	}, def, a, a)
+	if err := r.DeleteMulti(ctx, []string{"a1", "b", "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Keys are deleted in one call per backend, and repeated backends are
+	// cleaned once.
+	want := map[*aecachetest.FakeCache][]aecachetest.Call{
+		a:   {{Op: "deletemulti", Key: "a1,a2"}, {Op: "clean"}},
+		def: {{Op: "deletemulti", Key: "b"}, {Op: "clean"}},
+	}
+	for f, calls := range want {
+		if got := f.Calls(); !reflect.DeepEqual(got, calls) {
+			t.Errorf("calls = %v; want %v", got, calls)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package aecache
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// A ShardedMemoryCache represents a cache in the process memory split in
+// shards, each with its own lock, so operations on keys in different shards
+// do not contend.
+type ShardedMemoryCache struct {
+	shards []*MemoryCache
+}
+
+// NewShardedMemoryCache creates a new ShardedMemoryCache with n shards,
+// chosen by FNV hash of the key. It takes the options of NewMemoryCache;
+// a byte budget is split evenly between shards.
+func NewShardedMemoryCache(n int, opts ...Option) *ShardedMemoryCache {
+	if n < 1 {
+		n = 1
+	}
+	o := newOptions(opts...)
+	if o.maxBytes > 0 {
+		opts = append(opts, WithMaxBytes((o.maxBytes+n-1)/n))
+	}
+	a := &ShardedMemoryCache{shards: make([]*MemoryCache, n)}
+	for i := range a.shards {
+		a.shards[i] = NewMemoryCache(opts...)
+	}
+	return a
+}
+
+// shard returns the shard of a key.
+func (a *ShardedMemoryCache) shard(key string) *MemoryCache {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return a.shards[h.Sum32()%uint32(len(a.shards))]
+}
+
+// Set sets a key to a value with an expiration.
+func (a *ShardedMemoryCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return a.shard(key).Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *ShardedMemoryCache) SetItem(ctx context.Context, key string, item Item) error {
+	return a.shard(key).SetItem(ctx, key, item)
+}
+
+// SetItemIfLonger sets a key to an item, unless it is already expired or the
+// key is set to an item not expired which expires later.
+func (a *ShardedMemoryCache) SetItemIfLonger(ctx context.Context, key string, item Item) error {
+	return a.shard(key).SetItemIfLonger(ctx, key, item)
+}
+
+// SetItemMulti sets keys to items, skipping those already expired, in one
+// call per shard.
+func (a *ShardedMemoryCache) SetItemMulti(ctx context.Context, items map[string]Item) error {
+	shards := make(map[*MemoryCache]map[string]Item)
+	for key, item := range items {
+		s := a.shard(key)
+		if shards[s] == nil {
+			shards[s] = make(map[string]Item)
+		}
+		shards[s][key] = item
+	}
+	for s, items := range shards {
+		if err := s.SetItemMulti(ctx, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadOrStoreItem returns the item of a key if set and not expired, with
+// loaded true. Otherwise it sets the key to item, unless already expired, and
+// returns it with loaded false. It is atomic, as sync.Map.LoadOrStore.
+func (a *ShardedMemoryCache) LoadOrStoreItem(ctx context.Context, key string, item Item) (actual Item, loaded bool, err error) {
+	return a.shard(key).LoadOrStoreItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *ShardedMemoryCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return a.shard(key).Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *ShardedMemoryCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return a.shard(key).Get(ctx, key)
+}
+
+// GetItem gets the item for a key.
+func (a *ShardedMemoryCache) GetItem(ctx context.Context, key string) (Item, error) {
+	return a.shard(key).GetItem(ctx, key)
+}
+
+// Peek gets the item for a key, without modifying the cache.
+func (a *ShardedMemoryCache) Peek(ctx context.Context, key string) (Item, error) {
+	return a.shard(key).Peek(ctx, key)
+}
+
+// TTLs returns the remaining time to live of keys, omitting those missing or
+// expired. It holds the lock of each shard once.
+func (a *ShardedMemoryCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	shards := make(map[*MemoryCache][]string)
+	for _, key := range keys {
+		s := a.shard(key)
+		shards[s] = append(shards[s], key)
+	}
+	ttls := make(map[string]time.Duration)
+	for s, keys := range shards {
+		t, err := s.TTLs(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		for key, ttl := range t {
+			ttls[key] = ttl
+		}
+	}
+	return ttls, nil
+}
+
+// Clean deletes expired items in all shards.
+func (a *ShardedMemoryCache) Clean(ctx context.Context) error {
+	for _, s := range a.shards {
+		if err := s.Clean(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes a key.
+func (a *ShardedMemoryCache) Delete(ctx context.Context, key string) error {
+	return a.shard(key).Delete(ctx, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected, atomically. It returns whether the key was deleted.
+func (a *ShardedMemoryCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	return a.shard(key).DeleteIf(ctx, key, expected)
+}
+
+// DeleteMulti deletes keys.
+func (a *ShardedMemoryCache) DeleteMulti(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := a.shard(key).Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix deletes items whose key starts with prefix in all shards.
+func (a *ShardedMemoryCache) DeletePrefix(ctx context.Context, prefix string) error {
+	for _, s := range a.shards {
+		if err := s.DeletePrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushExcept deletes all items but those of the keys to keep in all shards.
+func (a *ShardedMemoryCache) FlushExcept(ctx context.Context, keep ...string) error {
+	for _, s := range a.shards {
+		if err := s.FlushExcept(ctx, keep...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteByTag deletes items whose TagMeta is tag in all shards.
+func (a *ShardedMemoryCache) DeleteByTag(ctx context.Context, tag string) error {
+	for _, s := range a.shards {
+		if err := s.DeleteByTag(ctx, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks the cache is healthy, which it always is.
+func (a *ShardedMemoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Name returns the name of the layer.
+func (a *ShardedMemoryCache) Name() string {
+	return "sharded"
+}
+
+// Len returns the number of items in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *ShardedMemoryCache) Len() int {
+	var n int
+	for _, s := range a.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Bytes returns the summed length of the values in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *ShardedMemoryCache) Bytes() int {
+	var n int
+	for _, s := range a.shards {
+		n += s.Bytes()
+	}
+	return n
+}
+
+// SortedKeys returns the keys of the items not expired, in sorted order.
+func (a *ShardedMemoryCache) SortedKeys(ctx context.Context) ([]string, error) {
+	return a.KeysPage(ctx, "", 0)
+}
+
+// KeysPage returns the keys of the items not expired in sorted order, after
+// a key and at most limit of them, or all if limit is 0.
+// Each shard returns its page, which are merged.
+func (a *ShardedMemoryCache) KeysPage(ctx context.Context, after string, limit int) ([]string, error) {
+	var keys []string
+	for _, s := range a.shards {
+		shard, err := s.KeysPage(ctx, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shard...)
+	}
+	return pageKeys(keys, after, limit), nil
+}
+
+// Hits returns the number of gets of a key since it was set, 0 if it is not
+// cached.
+func (a *ShardedMemoryCache) Hits(key string) uint64 {
+	return a.shard(key).Hits(key)
+}
+
+// Stats returns the counters of the cache, summed over shards.
+func (a *ShardedMemoryCache) Stats() Stats {
+	var stats Stats
+	for _, s := range a.shards {
+		shard := s.Stats()
+		stats.Hits += shard.Hits
+		stats.Misses += shard.Misses
+		stats.Evictions += shard.Evictions
+	}
+	return stats
+}
+
+// ScanPrefix returns the keys of the items not expired starting with prefix,
+// in sorted order.
+func (a *ShardedMemoryCache) ScanPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for _, s := range a.shards {
+		shard, err := s.ScanPrefix(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shard...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Snapshot returns a copy of the items not expired.
+func (a *ShardedMemoryCache) Snapshot(ctx context.Context) (map[string]Item, error) {
+	items := make(map[string]Item)
+	for _, s := range a.shards {
+		shard, err := s.Snapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for key, item := range shard {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,41 @@
+package aecache
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkParallel measures the throughput of a cache under concurrent
+// operations spread over 1024 keys: one set every setEvery, gets otherwise,
+// or only gets if setEvery is 0.
+func benchmarkParallel(b *testing.B, c Cache, setEvery int) {
+	ctx := context.Background()
+	const keys = 1024
+	for i := 0; i < keys; i++ {
+		if err := c.Set(ctx, strconv.Itoa(i), []byte("value"), time.Hour); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&seed, 7919))
+		for pb.Next() {
+			key := strconv.Itoa(i % keys)
+			if setEvery > 0 && i%setEvery == 0 {
+				c.Set(ctx, key, []byte("value"), time.Hour)
+			} else {
+				c.Get(ctx, key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedMemoryCache(b *testing.B) {
+	b.Run("memory", func(b *testing.B) { benchmarkParallel(b, NewMemoryCache(), 4) })
+	b.Run("sharded", func(b *testing.B) { benchmarkParallel(b, NewShardedMemoryCache(16), 4) })
+}
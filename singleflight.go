@@ -0,0 +1,67 @@
+package aecache
+
+import "sync"
+
+// A call represents an in-flight or completed flight call.
+type call struct {
+	wg    sync.WaitGroup
+	value Item
+	err   error
+}
+
+// A flight collapses concurrent calls for the same key into one.
+type flight struct {
+	m     sync.Mutex // protects below
+	calls map[string]*call
+}
+
+// Do executes f for a key, making sure only one execution is in flight at a
+// time. Duplicate callers wait for the original to complete and share its
+// results.
+func (g *flight) Do(key string, f func() (Item, error)) (Item, error) {
+	g.m.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.m.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.m.Unlock()
+	g.run(key, c, f)
+	return c.value, c.err
+}
+
+// Go executes f for a key in a new goroutine, unless an execution is already
+// in flight, in which case it does nothing. It returns whether f was
+// started. Callers of Do meanwhile wait for it and share its results.
+func (g *flight) Go(key string, f func() (Item, error)) bool {
+	g.m.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if _, ok := g.calls[key]; ok {
+		g.m.Unlock()
+		return false
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.m.Unlock()
+	go g.run(key, c, f)
+	return true
+}
+
+// run executes f for the call of a key, then forgets it.
+func (g *flight) run(key string, c *call, f func() (Item, error)) {
+	c.value, c.err = f()
+	c.wg.Done()
+
+	g.m.Lock()
+	delete(g.calls, key)
+	g.m.Unlock()
+}
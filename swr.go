@@ -0,0 +1,203 @@
+package aecache
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// freshMeta is the Meta key holding the freshness deadline of an item
+// in a stale-while-revalidate cache.
+const freshMeta = "aecache-fresh"
+
+// A swrCache represents a stale-while-revalidate cache: items are served
+// past their freshness deadline, up to a stale period, while being
+// refreshed in the background.
+type swrCache struct {
+	cache  Cache
+	loader Loader
+	stale  time.Duration
+	clock  Clock
+	logger *log.Logger
+	flight flight
+}
+
+// StaleWhileRevalidate wraps a cache so items are kept for a stale period
+// past their expiration. The expiration becomes a freshness deadline: past
+// it, GetItem returns the stale item immediately, with its past freshness
+// deadline as Expires, and refreshes it in the background with the loader.
+// Past the stale period, items are missed and loaded synchronously.
+// The freshness deadline is stored in the item Meta so it is shared across
+// layers; items stored without, e.g. by Add, are fresh until they expire.
+// It supports the WithClock and WithLogger options, the latter to log
+// failures of background refreshes.
+func StaleWhileRevalidate(cache Cache, loader Loader, stale time.Duration, opts ...Option) Cache {
+	o := newOptions(opts...)
+	return &swrCache{cache: cache, loader: loader, stale: stale, clock: o.clock, logger: o.logger}
+}
+
+// Set sets a key to a value, fresh for expiration.
+func (a *swrCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, fresh until it expires.
+func (a *swrCache) SetItem(ctx context.Context, key string, item Item) error {
+	meta := make(map[string]string, len(item.Meta)+1)
+	for k, v := range item.Meta {
+		meta[k] = v
+	}
+	meta[freshMeta] = item.Expires.Format(time.RFC3339Nano)
+	item.Meta = meta
+	item.Expires = item.Expires.Add(a.stale)
+	return a.cache.SetItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *swrCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	return a.cache.Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and freshness deadline for a key.
+func (a *swrCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key, with its freshness deadline as Expires.
+// A stale item is returned immediately and refreshed in the background,
+// unless a load of the key is already in flight.
+// On a miss, the item is loaded and stored.
+func (a *swrCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, err := a.cache.GetItem(ctx, key)
+	if err == ErrCacheMiss {
+		return a.load(ctx, key)
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	item = fresh(item)
+	if item.Expires.Before(a.clock.Now()) {
+		a.refresh(key)
+	}
+	return item, nil
+}
+
+// Peek gets the item for a key, with its freshness deadline as Expires, as
+// GetItem but without loading nor refreshing it, nor modifying the
+// underlying cache if it is a Peeker.
+func (a *swrCache) Peek(ctx context.Context, key string) (Item, error) {
+	item, err := peek(ctx, a.cache, key)
+	if err != nil {
+		return Item{}, err
+	}
+	return fresh(item), nil
+}
+
+// load loads and stores the item for a key, one load per key at a time.
+func (a *swrCache) load(ctx context.Context, key string) (Item, error) {
+	return a.flight.Do(key, func() (Item, error) {
+		return a.fetch(ctx, key)
+	})
+}
+
+// refresh loads and stores the item for a key in the background, unless a
+// load of the key is already in flight. Failures are logged.
+func (a *swrCache) refresh(key string) {
+	a.flight.Go(key, func() (Item, error) {
+		item, err := a.fetch(context.Background(), key)
+		if err != nil {
+			logf(a.logger, "aecache: refreshing %q: %v", key, err)
+		}
+		return item, err
+	})
+}
+
+// fetch loads and stores the item for a key.
+func (a *swrCache) fetch(ctx context.Context, key string) (Item, error) {
+	item, err := a.loader(ctx, key)
+	if err != nil {
+		return Item{}, err
+	}
+	if err := a.SetItem(ctx, key, item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// fresh returns an item with its freshness deadline as Expires, if it has
+// one, and without it in Meta.
+func fresh(item Item) Item {
+	v, ok := item.Meta[freshMeta]
+	if !ok {
+		return item
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		item.Expires = t
+	}
+	meta := make(map[string]string, len(item.Meta)-1)
+	for k, v := range item.Meta {
+		if k != freshMeta {
+			meta[k] = v
+		}
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	item.Meta = meta
+	return item
+}
+
+// Clean deletes expired items.
+func (a *swrCache) Clean(ctx context.Context) error {
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (a *swrCache) Delete(ctx context.Context, key string) error {
+	return a.cache.Delete(ctx, key)
+}
+
+// Invalidate removes a key and anything the underlying cache remembers
+// about it if it is an Invalidator.
+func (a *swrCache) Invalidate(ctx context.Context, key string) error {
+	return invalidate(ctx, a.cache, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *swrCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	return deleteIf(ctx, a.cache, key, expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *swrCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+func (a *swrCache) DeleteMulti(ctx context.Context, keys []string) error {
+	return a.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *swrCache) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func (a *swrCache) DeleteByTag(ctx context.Context, tag string) error {
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *swrCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
@@ -0,0 +1,127 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A syncBuffer is a bytes.Buffer safe for concurrent use, to log to.
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.String()
+}
+
+// eventually fails unless cond becomes true within a second.
+func eventually(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+	}
+}
+
+func TestStaleWhileRevalidateRefreshOnce(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	var loads int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) (Item, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return Item{Value: []byte("new"), Expires: clock.Now().Add(time.Minute)}, nil
+	}
+	c := StaleWhileRevalidate(NewMemoryCache(WithClock(clock)), loader, time.Hour, WithClock(clock))
+	c.Set(ctx, "k", []byte("old"), time.Minute)
+	clock.advance(2 * time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "old" {
+				t.Errorf("GetItem() = %q, %v; want old", item.Value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	eventually(t, func() bool {
+		item, err := c.(Peeker).Peek(ctx, "k")
+		return err == nil && string(item.Value) == "new"
+	}, "item not refreshed")
+	if got := atomic.LoadInt32(&loads); got != 1 {
+		t.Errorf("loads = %v, want 1", got)
+	}
+}
+
+func TestStaleWhileRevalidateLogsRefreshErrors(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	var buf syncBuffer
+	loader := func(ctx context.Context, key string) (Item, error) {
+		return Item{}, errors.New("backend down")
+	}
+	c := StaleWhileRevalidate(NewMemoryCache(WithClock(clock)), loader, time.Hour,
+		WithClock(clock), WithLogger(log.New(&buf, "", 0)))
+	c.Set(ctx, "k", []byte("old"), time.Minute)
+	clock.advance(2 * time.Minute)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "old" {
+		t.Fatalf("GetItem() = %q, %v; want old", item.Value, err)
+	}
+	eventually(t, func() bool {
+		return strings.Contains(buf.String(), `refreshing "k": backend down`)
+	}, "refresh error not logged")
+}
+
+func TestStaleWhileRevalidateExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	var loads int32
+	loader := func(ctx context.Context, key string) (Item, error) {
+		atomic.AddInt32(&loads, 1)
+		return Item{Value: []byte("new"), Expires: clock.Now().Add(time.Minute)}, nil
+	}
+	m := NewMemoryCache(WithClock(clock))
+	c := StaleWhileRevalidate(m, loader, time.Hour, WithClock(clock))
+	c.Set(ctx, "k", []byte("old"), time.Minute)
+	fresh := clock.Now().Add(time.Minute)
+	// Fresh items are served without loading, with their freshness deadline.
+	clock.advance(30 * time.Second)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "old" || !item.Expires.Equal(fresh) {
+		t.Errorf("GetItem() = %q expiring %v, %v; want old expiring %v", item.Value, item.Expires, err, fresh)
+	}
+	if item, err := m.Peek(ctx, "k"); err != nil || !item.Expires.Equal(fresh.Add(time.Hour)) {
+		t.Errorf("underlying item expires %v, %v; want kept for the stale period", item.Expires, err)
+	}
+	if got := atomic.LoadInt32(&loads); got != 0 {
+		t.Errorf("loads = %v, want 0 while fresh", got)
+	}
+	// Past the stale period, the item is a miss, loaded synchronously.
+	clock.advance(2 * time.Hour)
+	if item, err := c.GetItem(ctx, "k"); err != nil || string(item.Value) != "new" {
+		t.Errorf("GetItem() past the stale period = %q, %v; want new", item.Value, err)
+	}
+	if got := atomic.LoadInt32(&loads); got != 1 {
+		t.Errorf("loads = %v, want 1", got)
+	}
+}
@@ -0,0 +1,350 @@
+package aecache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A SyncMapCache represents a cache in the process memory for read-heavy
+// workloads: reads are lock-free, writes are serialized.
+// It has the semantics of MemoryCache, except it has no byte budget.
+type SyncMapCache struct {
+	hits      uint64 // atomic, first for alignment
+	misses    uint64 // atomic
+	evictions uint64 // atomic
+	clock     Clock
+	onEvict   func(ctx context.Context, key string, item Item, reason EvictReason)
+	items     sync.Map                       // key to *Item
+	m         sync.Mutex                     // serializes writes, protects below
+	tags      map[string]map[string]struct{} // tag to keys, for DeleteByTag
+	n         int                            // number of items
+	bytes     int                            // summed length of values
+}
+
+// NewSyncMapCache creates a new SyncMapCache.
+// It supports the WithClock and WithOnEvict options.
+func NewSyncMapCache(opts ...Option) *SyncMapCache {
+	o := newOptions(opts...)
+	return &SyncMapCache{
+		clock:   o.clock,
+		onEvict: o.onEvict,
+		tags:    make(map[string]map[string]struct{}),
+	}
+}
+
+// Set sets a key to a value with an expiration.
+func (a *SyncMapCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if expiration <= 0 {
+		return nil
+	}
+	return a.SetItem(ctx, key, Item{Value: value, Expires: a.clock.Now().Add(expiration)})
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *SyncMapCache) SetItem(ctx context.Context, key string, item Item) error {
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.store(ctx, key, &item)
+	return nil
+}
+
+// SetItemIfLonger sets a key to an item, unless it is already expired or the
+// key is set to an item not expired which expires later.
+func (a *SyncMapCache) SetItemIfLonger(ctx context.Context, key string, item Item) error {
+	if item.Expires.Before(a.clock.Now()) {
+		return nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if v, ok := a.items.Load(key); ok && v.(*Item).Expires.After(item.Expires) {
+		return nil
+	}
+	a.store(ctx, key, &item)
+	return nil
+}
+
+// LoadOrStoreItem returns the item of a key if set and not expired, with
+// loaded true. Otherwise it sets the key to item, unless already expired, and
+// returns it with loaded false. It is atomic, as sync.Map.LoadOrStore.
+func (a *SyncMapCache) LoadOrStoreItem(ctx context.Context, key string, item Item) (actual Item, loaded bool, err error) {
+	now := a.clock.Now()
+	if v, ok := a.items.Load(key); ok && !v.(*Item).Expires.Before(now) {
+		return *v.(*Item), true, nil
+	}
+	if item.Expires.Before(now) {
+		return item, false, nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if v, ok := a.items.Load(key); ok && !v.(*Item).Expires.Before(now) {
+		return *v.(*Item), true, nil
+	}
+	a.store(ctx, key, &item)
+	return item, false, nil
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *SyncMapCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		return false, nil
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	now := a.clock.Now()
+	if v, ok := a.items.Load(key); ok && !v.(*Item).Expires.Before(now) {
+		return false, nil
+	}
+	a.store(ctx, key, &Item{Value: value, Expires: now.Add(expiration)})
+	return true, nil
+}
+
+// Get gets the value and expiration for a key.
+func (a *SyncMapCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	item, err := a.GetItem(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return item.Value, item.Expires, nil
+}
+
+// GetItem gets the item for a key.
+func (a *SyncMapCache) GetItem(ctx context.Context, key string) (Item, error) {
+	v, ok := a.items.Load(key)
+	if !ok {
+		atomic.AddUint64(&a.misses, 1)
+		return Item{}, ErrCacheMiss
+	}
+	item := v.(*Item)
+	if item.Expires.Before(a.clock.Now()) {
+		a.evictIf(ctx, key, item, EvictExpired)
+		atomic.AddUint64(&a.misses, 1)
+		return Item{}, ErrCacheMiss
+	}
+	atomic.AddUint64(&a.hits, 1)
+	return *item, nil
+}
+
+// Peek gets the item for a key, without deleting it if expired.
+func (a *SyncMapCache) Peek(ctx context.Context, key string) (Item, error) {
+	v, ok := a.items.Load(key)
+	if !ok || v.(*Item).Expires.Before(a.clock.Now()) {
+		return Item{}, ErrCacheMiss
+	}
+	return *v.(*Item), nil
+}
+
+// TTLs returns the remaining time to live of keys, omitting those missing or
+// expired.
+func (a *SyncMapCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	now := a.clock.Now()
+	ttls := make(map[string]time.Duration)
+	for _, key := range keys {
+		if v, ok := a.items.Load(key); ok && !v.(*Item).Expires.Before(now) {
+			ttls[key] = v.(*Item).Expires.Sub(now)
+		}
+	}
+	return ttls, nil
+}
+
+// Clean deletes expired items.
+func (a *SyncMapCache) Clean(ctx context.Context) error {
+	now := a.clock.Now()
+	a.items.Range(func(k, v interface{}) bool {
+		if item := v.(*Item); item.Expires.Before(now) {
+			a.evictIf(ctx, k.(string), item, EvictExpired)
+		}
+		return true
+	})
+	return nil
+}
+
+// Delete deletes a key.
+func (a *SyncMapCache) Delete(ctx context.Context, key string) error {
+	if v, ok := a.items.Load(key); ok {
+		a.evictIf(ctx, key, v.(*Item), EvictDeleted)
+	}
+	return nil
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected, atomically. It returns whether the key was deleted.
+func (a *SyncMapCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	v, ok := a.items.Load(key)
+	if !ok {
+		return false, nil
+	}
+	item := v.(*Item)
+	if item.Expires.Before(a.clock.Now()) || !bytes.Equal(item.Value, expected) {
+		return false, nil
+	}
+	return a.evictIf(ctx, key, item, EvictDeleted), nil
+}
+
+// DeleteMulti deletes keys.
+func (a *SyncMapCache) DeleteMulti(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := a.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *SyncMapCache) DeletePrefix(ctx context.Context, prefix string) error {
+	a.items.Range(func(k, v interface{}) bool {
+		if key := k.(string); strings.HasPrefix(key, prefix) {
+			a.evictIf(ctx, key, v.(*Item), EvictDeleted)
+		}
+		return true
+	})
+	return nil
+}
+
+// FlushExcept deletes all items but those of the keys to keep, e.g. to
+// reset the cache but keep configuration.
+func (a *SyncMapCache) FlushExcept(ctx context.Context, keep ...string) error {
+	keys := keySet(keep)
+	a.items.Range(func(k, v interface{}) bool {
+		if _, ok := keys[k.(string)]; !ok {
+			a.evictIf(ctx, k.(string), v.(*Item), EvictDeleted)
+		}
+		return true
+	})
+	return nil
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+// Tagged items are indexed, at the cost of a map entry per tagged key.
+func (a *SyncMapCache) DeleteByTag(ctx context.Context, tag string) error {
+	a.m.Lock()
+	var keys []string
+	for key := range a.tags[tag] {
+		keys = append(keys, key)
+	}
+	a.m.Unlock()
+	for _, key := range keys {
+		if v, ok := a.items.Load(key); ok && v.(*Item).Meta[TagMeta] == tag {
+			a.evictIf(ctx, key, v.(*Item), EvictDeleted)
+		}
+	}
+	return nil
+}
+
+// Ping checks the cache is healthy, which it always is.
+func (a *SyncMapCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Name returns the name of the layer.
+func (a *SyncMapCache) Name() string {
+	return "syncmap"
+}
+
+// Len returns the number of items in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *SyncMapCache) Len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.n
+}
+
+// Bytes returns the summed length of the values in the cache.
+// Expired items are counted until removed by Get or Clean.
+func (a *SyncMapCache) Bytes() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.bytes
+}
+
+// SortedKeys returns the keys of the items not expired, in sorted order.
+func (a *SyncMapCache) SortedKeys(ctx context.Context) ([]string, error) {
+	return a.KeysPage(ctx, "", 0)
+}
+
+// KeysPage returns the keys of the items not expired in sorted order, after
+// a key and at most limit of them, or all if limit is 0.
+func (a *SyncMapCache) KeysPage(ctx context.Context, after string, limit int) ([]string, error) {
+	now := a.clock.Now()
+	var keys []string
+	a.items.Range(func(k, v interface{}) bool {
+		if key := k.(string); key > after && !v.(*Item).Expires.Before(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return pageKeys(keys, after, limit), nil
+}
+
+// Stats returns the counters of the cache.
+func (a *SyncMapCache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&a.hits),
+		Misses:    atomic.LoadUint64(&a.misses),
+		Evictions: atomic.LoadUint64(&a.evictions),
+	}
+}
+
+// evictIf removes a key if it is still set to item, and calls onEvict.
+// The write lock is taken so a concurrent Set is not lost.
+func (a *SyncMapCache) evictIf(ctx context.Context, key string, item *Item, reason EvictReason) bool {
+	a.m.Lock()
+	v, ok := a.items.Load(key)
+	if !ok || v.(*Item) != item {
+		a.m.Unlock()
+		return false
+	}
+	a.items.Delete(key)
+	a.untag(key, item)
+	a.n--
+	a.bytes -= len(item.Value)
+	a.m.Unlock()
+	if reason != EvictDeleted {
+		atomic.AddUint64(&a.evictions, 1)
+	}
+	if a.onEvict != nil {
+		a.onEvict(ctx, key, *item, reason)
+	}
+	return true
+}
+
+// store sets a key to an item and updates the tags index.
+// The write lock must be held.
+func (a *SyncMapCache) store(ctx context.Context, key string, item *Item) {
+	*item = stamp(ctx, *item, a.clock.Now())
+	if v, ok := a.items.Load(key); ok {
+		a.untag(key, v.(*Item))
+		a.n--
+		a.bytes -= len(v.(*Item).Value)
+	}
+	a.items.Store(key, item)
+	a.n++
+	a.bytes += len(item.Value)
+	if tag := item.Meta[TagMeta]; tag != "" {
+		if a.tags[tag] == nil {
+			a.tags[tag] = make(map[string]struct{})
+		}
+		a.tags[tag][key] = struct{}{}
+	}
+}
+
+// untag removes a key of an item from the tags index.
+// The write lock must be held.
+func (a *SyncMapCache) untag(key string, item *Item) {
+	tag := item.Meta[TagMeta]
+	if tag == "" {
+		return
+	}
+	delete(a.tags[tag], key)
+	if len(a.tags[tag]) == 0 {
+		delete(a.tags, tag)
+	}
+}
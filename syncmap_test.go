@@ -0,0 +1,44 @@
+package aecache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSyncMapCacheLenBytes(t *testing.T) {
+	ctx := context.Background()
+	a := NewSyncMapCache()
+	a.Set(ctx, "a", []byte("12345"), time.Hour)
+	a.Set(ctx, "b", []byte("123"), time.Hour)
+	a.Set(ctx, "a", []byte("12"), time.Hour)
+	if got, want := a.Len(), 2; got != want {
+		t.Errorf("Len() = %v, want %v", got, want)
+	}
+	if got, want := a.Bytes(), 5; got != want {
+		t.Errorf("Bytes() = %v, want %v", got, want)
+	}
+	a.Delete(ctx, "b")
+	if got, want := a.Len(), 1; got != want {
+		t.Errorf("Len() after Delete = %v, want %v", got, want)
+	}
+	if got, want := a.Bytes(), 2; got != want {
+		t.Errorf("Bytes() after Delete = %v, want %v", got, want)
+	}
+}
+
+func TestNewMemoryLayer(t *testing.T) {
+	if _, ok := NewMemoryLayer().(*MemoryCache); !ok {
+		t.Errorf("NewMemoryLayer() is not a MemoryCache")
+	}
+	if _, ok := NewMemoryLayer(WithSyncMap()).(*SyncMapCache); !ok {
+		t.Errorf("NewMemoryLayer(WithSyncMap()) is not a SyncMapCache")
+	}
+}
+
+func BenchmarkSyncMapCache(b *testing.B) {
+	b.Run("memory/get", func(b *testing.B) { benchmarkParallel(b, NewMemoryCache(), 0) })
+	b.Run("syncmap/get", func(b *testing.B) { benchmarkParallel(b, NewSyncMapCache(), 0) })
+	b.Run("memory/mixed", func(b *testing.B) { benchmarkParallel(b, NewMemoryCache(), 4) })
+	b.Run("syncmap/mixed", func(b *testing.B) { benchmarkParallel(b, NewSyncMapCache(), 4) })
+}
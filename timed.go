@@ -0,0 +1,141 @@
+package aecache
+
+import (
+	"context"
+	"time"
+)
+
+// A Recorder records the duration of cache operations, e.g. into histograms
+// backed by Prometheus or OpenTelemetry.
+type Recorder interface {
+	// Record records the duration of an operation on a layer.
+	Record(layer, op string, d time.Duration)
+}
+
+// NoopRecorder is a Recorder that records nothing.
+var NoopRecorder Recorder = noopRecorder{}
+
+type noopRecorder struct{}
+
+func (noopRecorder) Record(layer, op string, d time.Duration) {}
+
+// A timedCache represents a cache recording the duration of its operations.
+type timedCache struct {
+	cache    Cache
+	layer    string
+	recorder Recorder
+}
+
+// Timed wraps a cache to record the duration of its operations, tagged with
+// the layer name and operation (set, setitem, add, get, getitem, clean,
+// delete, deleteif, invalidate, deletemulti, deleteprefix, deletebytag).
+// Wrapping each layer of a CombinedCache gives per-layer latency. With a nil
+// or NoopRecorder, the cache is returned as is.
+func Timed(cache Cache, layer string, recorder Recorder) Cache {
+	if recorder == nil || recorder == NoopRecorder {
+		return cache
+	}
+	return &timedCache{cache: cache, layer: layer, recorder: recorder}
+}
+
+// Name returns the name of the layer.
+func (a *timedCache) Name() string {
+	return a.layer
+}
+
+// record records the duration of an operation started at start.
+func (a *timedCache) record(op string, start time.Time) {
+	a.recorder.Record(a.layer, op, time.Since(start))
+}
+
+// Set sets a key to a value with an expiration.
+func (a *timedCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	defer a.record("set", time.Now())
+	return a.cache.Set(ctx, key, value, expiration)
+}
+
+// SetItem sets a key to an item, unless it is already expired.
+func (a *timedCache) SetItem(ctx context.Context, key string, item Item) error {
+	defer a.record("setitem", time.Now())
+	return a.cache.SetItem(ctx, key, item)
+}
+
+// Add sets a key to a value with an expiration, only if the key is not
+// already set to a value not expired. It returns whether the key was set.
+func (a *timedCache) Add(ctx context.Context, key string, value []byte, expiration time.Duration) (bool, error) {
+	defer a.record("add", time.Now())
+	return a.cache.Add(ctx, key, value, expiration)
+}
+
+// Get gets the value and expiration for a key.
+func (a *timedCache) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	defer a.record("get", time.Now())
+	return a.cache.Get(ctx, key)
+}
+
+// GetItem gets the item for a key.
+func (a *timedCache) GetItem(ctx context.Context, key string) (Item, error) {
+	defer a.record("getitem", time.Now())
+	return a.cache.GetItem(ctx, key)
+}
+
+// Peek gets the item for a key, without modifying the underlying cache if it
+// is a Peeker.
+func (a *timedCache) Peek(ctx context.Context, key string) (Item, error) {
+	defer a.record("peek", time.Now())
+	return peek(ctx, a.cache, key)
+}
+
+// Clean deletes expired items.
+func (a *timedCache) Clean(ctx context.Context) error {
+	defer a.record("clean", time.Now())
+	return a.cache.Clean(ctx)
+}
+
+// Delete deletes a key.
+func (a *timedCache) Delete(ctx context.Context, key string) error {
+	defer a.record("delete", time.Now())
+	return a.cache.Delete(ctx, key)
+}
+
+// Invalidate removes a key and anything the underlying cache remembers
+// about it if it is an Invalidator.
+func (a *timedCache) Invalidate(ctx context.Context, key string) error {
+	defer a.record("invalidate", time.Now())
+	return invalidate(ctx, a.cache, key)
+}
+
+// DeleteIf deletes a key only if it is set to a value not expired equal to
+// expected. It returns whether the key was deleted.
+func (a *timedCache) DeleteIf(ctx context.Context, key string, expected []byte) (bool, error) {
+	defer a.record("deleteif", time.Now())
+	return deleteIf(ctx, a.cache, key, expected)
+}
+
+// canDeleteIf tells whether the underlying cache can delete conditionally.
+func (a *timedCache) canDeleteIf() bool {
+	return canDeleteIf(a.cache)
+}
+
+// DeleteMulti deletes keys.
+func (a *timedCache) DeleteMulti(ctx context.Context, keys []string) error {
+	defer a.record("deletemulti", time.Now())
+	return a.cache.DeleteMulti(ctx, keys)
+}
+
+// DeletePrefix deletes items whose key starts with prefix.
+func (a *timedCache) DeletePrefix(ctx context.Context, prefix string) error {
+	defer a.record("deleteprefix", time.Now())
+	return a.cache.DeletePrefix(ctx, prefix)
+}
+
+// DeleteByTag deletes items whose TagMeta is tag.
+func (a *timedCache) DeleteByTag(ctx context.Context, tag string) error {
+	defer a.record("deletebytag", time.Now())
+	return a.cache.DeleteByTag(ctx, tag)
+}
+
+// Ping checks the underlying cache is healthy, if it is a Pinger.
+func (a *timedCache) Ping(ctx context.Context) error {
+	return ping(ctx, a.cache)
+}
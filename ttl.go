@@ -0,0 +1,37 @@
+package aecache
+
+// A ttlHeap is a min-heap of the items of a MemoryCache by expiration, then
+// least recently used, for container/heap. Items record their index in it,
+// so they are removed or moved in place when deleted or accessed.
+type ttlHeap []*memoryItem
+
+func (h ttlHeap) Len() int { return len(h) }
+
+func (h ttlHeap) Less(i, j int) bool {
+	if !h[i].Expires.Equal(h[j].Expires) {
+		return h[i].Expires.Before(h[j].Expires)
+	}
+	return h[i].used < h[j].used
+}
+
+func (h ttlHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ttlHeap) Push(x interface{}) {
+	item := x.(*memoryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *ttlHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,62 @@
+package aecache
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// A TypedCache represents a cache of common types of values, stored as bytes
+// in a Cache: strings as is, integers in decimal and other values in JSON.
+type TypedCache struct {
+	Cache Cache
+}
+
+// NewTypedCache creates a new TypedCache on top of a Cache.
+func NewTypedCache(cache Cache) *TypedCache {
+	return &TypedCache{Cache: cache}
+}
+
+// SetString sets a key to a string with an expiration.
+func (a *TypedCache) SetString(ctx context.Context, key, value string, expiration time.Duration) error {
+	return a.Cache.Set(ctx, key, []byte(value), expiration)
+}
+
+// GetString gets the string and expiration for a key.
+func (a *TypedCache) GetString(ctx context.Context, key string) (string, time.Time, error) {
+	value, expires, err := a.Cache.Get(ctx, key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return string(value), expires, nil
+}
+
+// SetInt sets a key to an integer with an expiration.
+func (a *TypedCache) SetInt(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	return a.Cache.Set(ctx, key, []byte(strconv.FormatInt(value, 10)), expiration)
+}
+
+// GetInt gets the integer and expiration for a key.
+// It returns ErrNotInt if the value is not a decimal integer.
+func (a *TypedCache) GetInt(ctx context.Context, key string) (int64, time.Time, error) {
+	value, expires, err := a.Cache.Get(ctx, key)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, time.Time{}, ErrNotInt
+	}
+	return n, expires, nil
+}
+
+// SetJSON encodes a value in JSON and sets a key to it with an expiration.
+func (a *TypedCache) SetJSON(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	return NewCodecCache(a.Cache, JSONCodec).SetValue(ctx, key, v, expiration)
+}
+
+// GetJSON gets the value for a key and decodes it from JSON into v, a pointer.
+// It returns the expiration.
+func (a *TypedCache) GetJSON(ctx context.Context, key string, v interface{}) (time.Time, error) {
+	return NewCodecCache(a.Cache, JSONCodec).GetValue(ctx, key, v)
+}